@@ -47,7 +47,12 @@ func Process(logger *log.Logger, brokerProximity utils.Broker, session *gwUtils.
 		brokerMsgId := uuid.NewString()
 
 		switch msg.EventType {
-		case utils.ProximityRequestNearby, utils.ProximitySendLocation:
+		case utils.ProximityRequestNearby, utils.ProximitySendLocation, utils.ProximityRequestBox, utils.ProximityRequestPolygon,
+			utils.ProximityCreateGeofence, utils.ProximityDeleteGeofence, utils.ProximityListGeofences,
+			utils.ProximitySubscribeNearby, utils.ProximityUnsubscribeNearby, utils.ProximitySendLocationBatch,
+			utils.ProximityRequestTrail, utils.ProximityRemoveLocation, utils.ProximitySetPrivacy, utils.ProximityGetPrivacy,
+			utils.ProximityBlockUser, utils.ProximityUnblockUser, utils.ProximityAddFriend, utils.ProximityRemoveFriend,
+			utils.ProximitySetVisibility, utils.ProximityGetVisibility:
 			brokerProximity.Send(&utils.BrokerMessage{Id: brokerMsgId, Receiver: receiver, User: user.Subject, EventType: msg.EventType, Body: msg.Body})
 
 			logger.Println("process.sent: sent message to proximity broker")
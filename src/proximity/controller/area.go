@@ -0,0 +1,178 @@
+package controller
+
+import (
+	"log"
+
+	pUtils "github.com/bengosborn/cue/proximity/utils"
+	"github.com/bengosborn/cue/utils"
+)
+
+// Reply with the users near the user in the same group
+func handleNearby(groups *pUtils.Groups, visibility visibilityLookup, privacy privacyLookup, brokerOut utils.Broker, logger *log.Logger, msg *utils.BrokerMessage) bool {
+	// Parse the query options
+	query, err := pUtils.NewNearbyQuery(msg.Body)
+	if err != nil {
+		logger.Println("controller.error: invalid nearby query")
+		replyError(brokerOut, msg, err, logger)
+
+		return true
+	}
+
+	// Request a list of users from the request
+	location, err := groups.Get(query.Group)
+	if err != nil {
+		logger.Println("controller.error: ", err)
+		replyError(brokerOut, msg, err, logger)
+
+		return true
+	}
+
+	// Only members with a location in the group may query it
+	userData, err := location.Get(msg.User)
+	if err != nil {
+		logger.Println("controller.error: ", err)
+		replyError(brokerOut, msg, err, logger)
+
+		return true
+	}
+
+	// Candidates are found around the exact positions as far as the largest privacy grid in use then matched where they are shown
+	padding, err := privacy.Padding()
+	if err != nil {
+		logger.Println("controller.error: ", err)
+		replyError(brokerOut, msg, err, logger)
+
+		return false
+	}
+
+	out, err := location.Nearby(msg.User, query.Radius+padding, query.Freshness())
+	if err != nil {
+		logger.Println("controller.error: failed to retrieve nearby users")
+		replyError(brokerOut, msg, err, logger)
+
+		return false
+	}
+
+	area := pUtils.NewRadiusArea(userData.Lat, userData.Long, query.Radius)
+
+	if !replyUsers(brokerOut, visibility, privacy, msg, &query.PageQuery, area, out, logger) {
+		return false
+	}
+
+	logger.Println("controller.success: retrieved nearby")
+
+	return true
+}
+
+// Reply with the users of a group inside a bounding box
+func handleBox(groups *pUtils.Groups, visibility visibilityLookup, privacy privacyLookup, brokerOut utils.Broker, logger *log.Logger, msg *utils.BrokerMessage) bool {
+	query, err := pUtils.NewBoxQuery(msg.Body)
+	if err != nil {
+		logger.Println("controller.error: invalid box query")
+		replyError(brokerOut, msg, err, logger)
+
+		return true
+	}
+
+	location, err := groups.Get(query.Group)
+	if err != nil {
+		logger.Println("controller.error: ", err)
+		replyError(brokerOut, msg, err, logger)
+
+		return true
+	}
+
+	// Only members with a location in the group may query it
+	if _, err := location.Get(msg.User); err != nil {
+		logger.Println("controller.error: ", err)
+		replyError(brokerOut, msg, err, logger)
+
+		return true
+	}
+
+	// Candidates are found around the exact positions as far as the largest privacy grid in use then matched where they are shown
+	padding, err := privacy.Padding()
+	if err != nil {
+		logger.Println("controller.error: ", err)
+		replyError(brokerOut, msg, err, logger)
+
+		return false
+	}
+
+	minLat, minLong, maxLat, maxLong := pUtils.PadBox(query.MinLat, query.MinLong, query.MaxLat, query.MaxLong, padding)
+
+	out, err := location.Box(msg.User, minLat, minLong, maxLat, maxLong, query.Freshness())
+	if err != nil {
+		logger.Println("controller.error: failed to retrieve users in box")
+		replyError(brokerOut, msg, err, logger)
+
+		return false
+	}
+
+	area := pUtils.NewBoxArea(query.MinLat, query.MinLong, query.MaxLat, query.MaxLong)
+
+	if !replyUsers(brokerOut, visibility, privacy, msg, &query.PageQuery, area, out, logger) {
+		return false
+	}
+
+	logger.Println("controller.success: retrieved users in box")
+
+	return true
+}
+
+// Reply with the users of a group inside a polygon
+func handlePolygon(groups *pUtils.Groups, visibility visibilityLookup, privacy privacyLookup, brokerOut utils.Broker, logger *log.Logger, msg *utils.BrokerMessage) bool {
+	query, err := pUtils.NewPolygonQuery(msg.Body)
+	if err != nil {
+		logger.Println("controller.error: invalid polygon query")
+		replyError(brokerOut, msg, err, logger)
+
+		return true
+	}
+
+	location, err := groups.Get(query.Group)
+	if err != nil {
+		logger.Println("controller.error: ", err)
+		replyError(brokerOut, msg, err, logger)
+
+		return true
+	}
+
+	// Only members with a location in the group may query it
+	if _, err := location.Get(msg.User); err != nil {
+		logger.Println("controller.error: ", err)
+		replyError(brokerOut, msg, err, logger)
+
+		return true
+	}
+
+	// Candidates are found in the bounds of the polygon around the exact positions as far as the largest privacy grid in use then matched where they are shown
+	padding, err := privacy.Padding()
+	if err != nil {
+		logger.Println("controller.error: ", err)
+		replyError(brokerOut, msg, err, logger)
+
+		return false
+	}
+
+	minLat, minLong, maxLat, maxLong := pUtils.PolygonBounds(query.Points)
+	minLat, minLong, maxLat, maxLong = pUtils.PadBox(minLat, minLong, maxLat, maxLong, padding)
+
+	out, err := location.Box(msg.User, minLat, minLong, maxLat, maxLong, query.Freshness())
+	if err != nil {
+		logger.Println("controller.error: failed to retrieve users in polygon")
+		replyError(brokerOut, msg, err, logger)
+
+		return false
+	}
+
+	area := pUtils.NewPolygonArea(query.Points)
+
+	if !replyUsers(brokerOut, visibility, privacy, msg, &query.PageQuery, area, out, logger) {
+		return false
+	}
+
+	logger.Println("controller.success: retrieved users in polygon")
+
+	return true
+}
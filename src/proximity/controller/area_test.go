@@ -0,0 +1,48 @@
+package controller
+
+import (
+	"context"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	pUtils "github.com/bengosborn/cue/proximity/utils"
+	"github.com/bengosborn/cue/utils"
+)
+
+func TestAreaQueriesRequireMembership(t *testing.T) {
+	location, err := pUtils.NewLocation(context.Background(), "test", time.Minute, time.Second, nil, &pUtils.SpatialIndexConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	groups := pUtils.NewGroups(context.Background(), nil, location, nil)
+	logger := log.New(io.Discard, "", 0)
+
+	if err := location.Upsert("member", &pUtils.UserData{Lat: 37.7749, Long: -122.4194}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Users without a location are answered with an error before anything is read
+	for _, msg := range []*utils.BrokerMessage{
+		{User: "stranger", EventType: utils.ProximityRequestNearby, Body: `{"radius": 1000}`},
+		{User: "stranger", EventType: utils.ProximityRequestBox, Body: `{"minLat": 37.7, "minLong": -122.5, "maxLat": 37.8, "maxLong": -122.4}`},
+		{User: "stranger", EventType: utils.ProximityRequestPolygon, Body: `{"points": [{"lat": 37.7, "long": -122.5}, {"lat": 37.8, "long": -122.5}, {"lat": 37.8, "long": -122.4}]}`},
+	} {
+		brokerOut := &captureBroker{}
+
+		switch msg.EventType {
+		case utils.ProximityRequestNearby:
+			handleNearby(groups, nil, nil, brokerOut, logger, msg)
+		case utils.ProximityRequestBox:
+			handleBox(groups, nil, nil, brokerOut, logger, msg)
+		case utils.ProximityRequestPolygon:
+			handlePolygon(groups, nil, nil, brokerOut, logger, msg)
+		}
+
+		if len(brokerOut.messages) != 1 || brokerOut.messages[0].EventType != utils.Error {
+			t.Fatalf("event %d did not reply with an error for a user outside the group", msg.EventType)
+		}
+	}
+}
@@ -2,7 +2,6 @@ package controller
 
 import (
 	"context"
-	"encoding/json"
 	"log"
 	"time"
 
@@ -11,12 +10,34 @@ import (
 )
 
 const (
-	radius   = 5
-	syncTime = time.Second * 60
+	syncTime     = time.Second * 5
+	loadTime     = time.Second * 60
+	evictTime    = time.Second * 30
+	snapshotTime = time.Second * 60
 )
 
 // Routing logic for all broker messages
-func Controller(ctx context.Context, location *pUtils.Location, brokerIn utils.Broker, brokerOut utils.Broker, lock *utils.ResourceLockDistributed, logger *log.Logger) {
+func Controller(ctx context.Context, groups *pUtils.Groups, geofences *pUtils.Geofences, subscriptions *pUtils.Subscriptions, history *pUtils.History, privacy *pUtils.Privacy, visibility *pUtils.Visibility, movement *pUtils.MovementPolicy, brokerIn utils.Broker, brokerOut utils.Broker, brokerSecurity utils.Broker, lock *utils.ResourceLockDistributed, logger *log.Logger) {
+	// Shards claim the users they store before anything else is notified where only the default group is sharded
+	sharded, isSharded := groups.Default().(*pUtils.ShardedLocation)
+	if isSharded {
+		sharded.OnUpsert(claimShard(sharded, logger))
+	}
+
+	// Notify geofences and subscribers of local upserts in every group
+	groups.OnUpsert(func(group string, location pUtils.LocationStore) func(*pUtils.UserData) {
+		return notifyGeofences(group, geofences, visibility, privacy, brokerOut, logger)
+	})
+	groups.OnUpsert(func(group string, location pUtils.LocationStore) func(*pUtils.UserData) {
+		return notifyNearby(group, subscriptions, visibility, privacy, brokerOut, logger)
+	})
+
+	if history != nil {
+		groups.OnUpsert(func(group string, location pUtils.LocationStore) func(*pUtils.UserData) {
+			return recordHistory(history, logger)
+		})
+	}
+
 	// Background sync
 	go func() {
 		for {
@@ -26,71 +47,183 @@ func Controller(ctx context.Context, location *pUtils.Location, brokerIn utils.B
 			case <-ctx.Done():
 				return
 			case <-timer:
-				location.Sync()
-				logger.Println("controller.success: location synced")
+				if err := groups.Sync(); err != nil {
+					logger.Println("controller.error: ", err)
+				}
 			}
 		}
 	}()
 
-	// Listen for new messages
-	if err := brokerIn.Listen(func(msg *utils.BrokerMessage) bool {
-		switch msg.EventType {
-		case (utils.ProximitySendLocation):
-			// Extract user data
-			userData := &pUtils.UserData{}
-			if err := json.Unmarshal([]byte(msg.Body), userData); err != nil {
-				logger.Println("controller.error: ", err)
-				return false
-			}
+	// Background snapshot for instances starting later
+	go func() {
+		for {
+			timer := time.After(snapshotTime)
 
-			if err := location.Upsert(msg.User, userData.Lat, userData.Long); err != nil {
-				logger.Println("controller.error: ", err)
-				return false
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer:
+				if err := groups.Snapshot(); err != nil {
+					logger.Println("controller.error: ", err)
+				} else {
+					logger.Println("controller.success: location snapshot stored")
+				}
 			}
+		}
+	}()
 
-			logger.Println("controller.success: upserted user location data")
+	// Background reload of geofences
+	go func() {
+		for {
+			timer := time.After(loadTime)
 
-			return true
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer:
+				if err := geofences.Load(); err != nil {
+					logger.Println("controller.error: ", err)
+				} else {
+					logger.Println("controller.success: geofences reloaded")
+				}
+			}
+		}
+	}()
 
-		case (utils.ProximityRequestNearby):
-			// Request a list of users from the request
-			out, err := location.Nearby(msg.User, radius)
-			if err != nil {
-				logger.Println("controller.error: failed to retrieve nearby users")
+	// Background eviction of expired users
+	go func() {
+		for {
+			timer := time.After(evictTime)
 
-				if err := brokerOut.Send(&utils.BrokerMessage{Id: msg.Id, Receiver: msg.Receiver, User: msg.User, EventType: utils.Error, Body: err.Error()}); err != nil {
-					logger.Println("controller.error: failed to send message")
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer:
+				stats, err := groups.Evict()
+				if err != nil {
+					logger.Println("controller.error: ", err)
+
+					continue
 				}
 
-				return false
+				total := groups.Evicted()
+
+				logger.Printf("controller.success: evicted %d users, %d tombstones and %d events (total %d users, %d tombstones and %d events)\n", stats.Users, stats.Tombstones, stats.Events, total.Users, total.Tombstones, total.Events)
 			}
+		}
+	}()
 
-			// Send the nearby to the user
-			data, err := json.Marshal(out)
-			if err != nil {
-				logger.Println("controller.error: failed to serialize data")
+	// Handle messages owned by this instance
+	handle := func(msg *utils.BrokerMessage) bool {
+		switch msg.EventType {
+		case (utils.ProximitySendLocation):
+			return handleSendLocation(groups, geofences, subscriptions, movement, brokerOut, brokerSecurity, logger, msg)
 
-				if err := brokerOut.Send(&utils.BrokerMessage{Id: msg.Id, Receiver: msg.Receiver, User: msg.User, EventType: utils.Error, Body: err.Error()}); err != nil {
-					logger.Println("controller.error: failed to send message")
-				}
+		case (utils.ProximitySendLocationBatch):
+			return handleSendLocationBatch(groups, geofences, history, subscriptions, movement, brokerOut, brokerSecurity, logger, msg)
+
+		case (utils.ProximityRemoveLocation):
+			return handleRemoveLocation(groups, brokerOut, logger, msg)
+
+		case (utils.ProximityRequestNearby):
+			return handleNearby(groups, visibility, privacy, brokerOut, logger, msg)
+
+		case (utils.ProximityRequestBox):
+			return handleBox(groups, visibility, privacy, brokerOut, logger, msg)
+
+		case (utils.ProximityRequestPolygon):
+			return handlePolygon(groups, visibility, privacy, brokerOut, logger, msg)
+
+		case (utils.ProximityCreateGeofence):
+			return handleCreateGeofence(groups, geofences, brokerOut, logger, msg)
+
+		case (utils.ProximityDeleteGeofence):
+			return handleDeleteGeofence(geofences, brokerOut, logger, msg)
+
+		case (utils.ProximityListGeofences):
+			return handleListGeofences(geofences, brokerOut, logger, msg)
+
+		case (utils.ProximityRequestTrail):
+			return handleTrail(history, brokerOut, logger, msg)
+
+		case (utils.ProximitySubscribeNearby):
+			return handleSubscribeNearby(subscriptions, brokerOut, logger, msg)
+
+		case (utils.ProximityUnsubscribeNearby):
+			return handleUnsubscribeNearby(subscriptions, brokerOut, logger, msg)
+
+		case (utils.ProximitySetPrivacy):
+			return handleSetPrivacy(privacy, brokerOut, logger, msg)
+
+		case (utils.ProximityGetPrivacy):
+			return handleGetPrivacy(privacy, brokerOut, logger, msg)
+
+		case (utils.ProximityBlockUser):
+			return handleVisibilityTarget(visibility, visibility.Block, brokerOut, logger, msg)
+
+		case (utils.ProximityUnblockUser):
+			return handleVisibilityTarget(visibility, visibility.Unblock, brokerOut, logger, msg)
 
-				return false
+		case (utils.ProximityAddFriend):
+			return handleVisibilityTarget(visibility, visibility.AddFriend, brokerOut, logger, msg)
+
+		case (utils.ProximityRemoveFriend):
+			return handleVisibilityTarget(visibility, visibility.RemoveFriend, brokerOut, logger, msg)
+
+		case (utils.ProximitySetVisibility):
+			return handleSetVisibility(visibility, brokerOut, logger, msg)
+
+		case (utils.ProximityGetVisibility):
+			return replyVisibility(visibility, brokerOut, logger, msg)
+
+		case (utils.ProximityShardQuery):
+			if isSharded {
+				return handleShardQuery(sharded, logger, msg)
 			}
 
-			if err := brokerOut.Send(&utils.BrokerMessage{Id: msg.Id, Receiver: msg.Receiver, User: msg.User, EventType: utils.ProximityRequestNearby, Body: string(data)}); err != nil {
-				logger.Println("controller.error: retrieved nearby but failed to send for reason ", err)
+			return true
 
-				return false
+		case (utils.ProximityShardResult):
+			if isSharded {
+				return handleShardResult(sharded, logger, msg)
 			}
 
-			logger.Println("controller.success: retrieved nearby")
+			return true
+
+		case (utils.ProximityShardRelease):
+			if isSharded {
+				return handleShardRelease(sharded, logger, msg)
+			}
 
 			return true
 
 		default:
 			return true
 		}
+	}
+
+	// Listen for messages forwarded to this shard and results of queries sent to other shards
+	if isSharded {
+		go func() {
+			if err := sharded.ShardBroker().Listen(handle, lock); err != nil {
+				logger.Fatalln("controller.error:", err)
+			}
+		}()
+
+		go func() {
+			if err := sharded.ReplyBroker().Listen(handle, nil); err != nil {
+				logger.Fatalln("controller.error:", err)
+			}
+		}()
+	}
+
+	// Listen for new messages
+	if err := brokerIn.Listen(func(msg *utils.BrokerMessage) bool {
+		if isSharded && routeShard(sharded, logger, msg) {
+			return true
+		}
 
+		return handle(msg)
 	}, lock); err != nil {
 		logger.Fatalln("controller.error:", err)
 	}
@@ -0,0 +1,169 @@
+package controller
+
+import (
+	"encoding/json"
+	"log"
+
+	pUtils "github.com/bengosborn/cue/proximity/utils"
+	"github.com/bengosborn/cue/utils"
+	"github.com/google/uuid"
+)
+
+type deleteGeofenceBody struct {
+	Id string `json:"id"`
+}
+
+// Create a geofence owned by the user in a group they are a member of
+func handleCreateGeofence(groups *pUtils.Groups, geofences *pUtils.Geofences, brokerOut utils.Broker, logger *log.Logger, msg *utils.BrokerMessage) bool {
+	fence, err := pUtils.NewGeofence(msg.Body, msg.User, msg.Receiver)
+	if err != nil {
+		logger.Println("controller.error: invalid geofence")
+		replyError(brokerOut, msg, err, logger)
+
+		return true
+	}
+
+	// Only members with a location in the group may watch it
+	location, err := groups.Get(fence.Group)
+	if err != nil {
+		logger.Println("controller.error: ", err)
+		replyError(brokerOut, msg, err, logger)
+
+		return true
+	}
+
+	if _, err := location.Get(msg.User); err != nil {
+		logger.Println("controller.error: ", err)
+		replyError(brokerOut, msg, err, logger)
+
+		return true
+	}
+
+	if err := geofences.Create(fence); err != nil {
+		logger.Println("controller.error: ", err)
+		replyError(brokerOut, msg, err, logger)
+
+		return false
+	}
+
+	data, err := json.Marshal(fence)
+	if err != nil {
+		logger.Println("controller.error: failed to serialize data")
+
+		return false
+	}
+
+	if err := reply(brokerOut, msg, msg.EventType, string(data)); err != nil {
+		logger.Println("controller.error: created geofence but failed to send for reason ", err)
+
+		return false
+	}
+
+	logger.Println("controller.success: created geofence")
+
+	return true
+}
+
+// Delete a geofence owned by the user
+func handleDeleteGeofence(geofences *pUtils.Geofences, brokerOut utils.Broker, logger *log.Logger, msg *utils.BrokerMessage) bool {
+	body := &deleteGeofenceBody{}
+	if err := json.Unmarshal([]byte(msg.Body), body); err != nil {
+		logger.Println("controller.error: ", err)
+		replyError(brokerOut, msg, err, logger)
+
+		return true
+	}
+
+	if err := geofences.Delete(msg.User, body.Id); err != nil {
+		logger.Println("controller.error: ", err)
+		replyError(brokerOut, msg, err, logger)
+
+		return true
+	}
+
+	if err := reply(brokerOut, msg, msg.EventType, body.Id); err != nil {
+		logger.Println("controller.error: deleted geofence but failed to send for reason ", err)
+
+		return false
+	}
+
+	logger.Println("controller.success: deleted geofence")
+
+	return true
+}
+
+// Reply with the geofences owned by the user
+func handleListGeofences(geofences *pUtils.Geofences, brokerOut utils.Broker, logger *log.Logger, msg *utils.BrokerMessage) bool {
+	data, err := json.Marshal(geofences.List(msg.User))
+	if err != nil {
+		logger.Println("controller.error: failed to serialize data")
+
+		return false
+	}
+
+	if err := reply(brokerOut, msg, msg.EventType, string(data)); err != nil {
+		logger.Println("controller.error: listed geofences but failed to send for reason ", err)
+
+		return false
+	}
+
+	logger.Println("controller.success: listed geofences")
+
+	return true
+}
+
+// Notify geofence owners of a group when a user enters or exits their geofences where the user is placed where they are shown
+func notifyGeofences(group string, geofences geofenceUpdater, visibility visibilityLookup, privacy privacyLookup, brokerOut utils.Broker, logger *log.Logger) func(*pUtils.UserData) {
+	return func(userData *pUtils.UserData) {
+		// Users inside a hidden zone never trigger geofence events
+		settings, err := privacy.Get(userData.User)
+		if err != nil {
+			logger.Println("controller.error: ", err)
+
+			return
+		}
+
+		if settings.Hidden(userData.Lat, userData.Long) {
+			return
+		}
+
+		shown := &pUtils.UserData{User: userData.User, Timestamp: userData.Timestamp}
+		shown.Lat, shown.Long = settings.Position(userData.Lat, userData.Long)
+
+		transitions, err := geofences.Update(group, shown)
+		if err != nil {
+			logger.Println("controller.error: ", err)
+
+			return
+		}
+
+		for _, transition := range transitions {
+			fence := transition.Geofence
+
+			// Owners only hear about users they may see
+			if visible, err := visibility.Visible(fence.Owner, userData.User); err != nil || !visible {
+				continue
+			}
+
+			eventType := utils.ProximityGeofenceExit
+			if transition.Entered {
+				eventType = utils.ProximityGeofenceEnter
+			}
+
+			data, err := json.Marshal(&pUtils.GeofenceEvent{Geofence: fence.Id, Name: fence.Name, User: userData.User, Timestamp: userData.Timestamp})
+			if err != nil {
+				logger.Println("controller.error: failed to serialize data")
+
+				continue
+			}
+
+			if err := brokerOut.Send(&utils.BrokerMessage{Id: uuid.NewString(), Receiver: fence.Receiver, User: fence.Owner, EventType: eventType, Body: string(data)}); err != nil {
+				logger.Println("controller.error: failed to send message")
+
+				continue
+			}
+
+			logger.Println("controller.success: sent geofence notification")
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+
+	pUtils "github.com/bengosborn/cue/proximity/utils"
+	"github.com/bengosborn/cue/utils"
+)
+
+// Reply with the trail of the user between two timestamps
+func handleTrail(history *pUtils.History, brokerOut utils.Broker, logger *log.Logger, msg *utils.BrokerMessage) bool {
+	if history == nil {
+		logger.Println("controller.error: history is disabled")
+		replyError(brokerOut, msg, errors.New("history is disabled"), logger)
+
+		return true
+	}
+
+	query, err := pUtils.NewTrailQuery(msg.Body)
+	if err != nil {
+		logger.Println("controller.error: invalid trail query")
+		replyError(brokerOut, msg, err, logger)
+
+		return true
+	}
+
+	fixes, err := history.Trail(msg.User, query.From, query.To)
+	if err != nil {
+		logger.Println("controller.error: failed to retrieve trail")
+		replyError(brokerOut, msg, err, logger)
+
+		return false
+	}
+
+	data, err := json.Marshal(&pUtils.TrailResponse{Version: pUtils.TrailResponseVersion, Fixes: fixes})
+	if err != nil {
+		logger.Println("controller.error: failed to serialize data")
+
+		return false
+	}
+
+	if err := reply(brokerOut, msg, msg.EventType, string(data)); err != nil {
+		logger.Println("controller.error: retrieved trail but failed to send for reason ", err)
+
+		return false
+	}
+
+	logger.Println("controller.success: retrieved trail")
+
+	return true
+}
+
+// Record every local upsert in the history
+func recordHistory(history *pUtils.History, logger *log.Logger) func(*pUtils.UserData) {
+	return func(userData *pUtils.UserData) {
+		if err := history.Record(userData.User, []*pUtils.UserData{userData}); err != nil {
+			logger.Println("controller.error: ", err)
+		}
+	}
+}
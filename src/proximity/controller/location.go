@@ -0,0 +1,212 @@
+package controller
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	pUtils "github.com/bengosborn/cue/proximity/utils"
+	"github.com/bengosborn/cue/utils"
+)
+
+// Store the location sent by a user in each of their groups
+func handleSendLocation(groups *pUtils.Groups, geofences *pUtils.Geofences, subscriptions *pUtils.Subscriptions, movement *pUtils.MovementPolicy, brokerOut utils.Broker, brokerSecurity utils.Broker, logger *log.Logger, msg *utils.BrokerMessage) bool {
+	// Extract user data
+	userData := &pUtils.UserData{}
+	if err := json.Unmarshal([]byte(msg.Body), userData); err != nil {
+		logger.Println("controller.error: ", err)
+		replyError(brokerOut, msg, err, logger)
+
+		return true
+	}
+
+	if err := userData.Validate(); err != nil {
+		logger.Println("controller.error: ", err)
+		replyError(brokerOut, msg, err, logger)
+
+		return true
+	}
+
+	// Groups are created by the first member to send a location
+	scope, err := pUtils.NewGroupScope(msg.Body)
+	if err != nil {
+		logger.Println("controller.error: ", err)
+		replyError(brokerOut, msg, err, logger)
+
+		return true
+	}
+
+	locations, err := groups.JoinScope(scope, msg.User)
+	if err != nil {
+		logger.Println("controller.error: ", err)
+		replyError(brokerOut, msg, err, logger)
+
+		return true
+	}
+
+	// Clients without a clock are stamped on arrival so the movement is still checked and every group stores the same fix
+	if userData.Timestamp.IsZero() {
+		userData.Timestamp = time.Now()
+	}
+
+	// Check the movement since the previous location before anything is upserted
+	if violation := movement.Check(msg.User, previousLocation(movement, locations[0], logger, msg.User), userData); violation != nil {
+		reportMovement(brokerSecurity, logger, msg, violation)
+
+		if violation.Action == pUtils.MovementReject {
+			replyError(brokerOut, msg, pUtils.ErrImpossibleMovement, logger)
+
+			return true
+		}
+	}
+
+	for _, location := range locations {
+		// Fixes older than the stored location are dropped
+		if err := location.Upsert(msg.User, userData); err == pUtils.ErrStaleLocation {
+			logger.Println("controller.success: ignored stale user location data")
+
+			continue
+		} else if err != nil {
+			logger.Println("controller.error: ", err)
+			replyError(brokerOut, msg, err, logger)
+
+			return true
+		}
+
+		logger.Println("controller.success: upserted user location data")
+	}
+
+	if err := movement.Record(msg.User, userData); err != nil {
+		logger.Println("controller.error: ", err)
+	}
+
+	// Keep alerts and geofence events flowing to the latest connection of the user
+	if err := subscriptions.Refresh(msg.User, msg.Receiver); err != nil {
+		logger.Println("controller.error: ", err)
+	}
+
+	if err := geofences.Refresh(msg.User, msg.Receiver); err != nil {
+		logger.Println("controller.error: ", err)
+	}
+
+	return true
+}
+
+// Store a batch of buffered locations sent by a user in each of their groups
+func handleSendLocationBatch(groups *pUtils.Groups, geofences *pUtils.Geofences, history *pUtils.History, subscriptions *pUtils.Subscriptions, movement *pUtils.MovementPolicy, brokerOut utils.Broker, brokerSecurity utils.Broker, logger *log.Logger, msg *utils.BrokerMessage) bool {
+	batch, err := pUtils.NewGroupBatch(msg.Body)
+	if err != nil {
+		logger.Println("controller.error: ", err)
+		replyError(brokerOut, msg, err, logger)
+
+		return true
+	}
+
+	locations, err := groups.JoinScope(&batch.GroupScope, msg.User)
+	if err != nil {
+		logger.Println("controller.error: ", err)
+		replyError(brokerOut, msg, err, logger)
+
+		return true
+	}
+
+	// Fixes are checked in time order so a single jump is reported once
+	violations := movement.CheckBatch(msg.User, previousLocation(movement, locations[0], logger, msg.User), batch.Fixes)
+	for _, violation := range violations {
+		reportMovement(brokerSecurity, logger, msg, violation)
+	}
+
+	// Every group validates the batch the same way so the first group decides the reply and history
+	var result *pUtils.BatchResult
+	var recorded []*pUtils.UserData
+
+	for i, location := range locations {
+		groupResult, groupRecorded, err := movement.UpsertBatch(location, msg.User, batch.Fixes, violations)
+		if err != nil {
+			logger.Println("controller.error: ", err)
+			replyError(brokerOut, msg, err, logger)
+
+			return true
+		}
+
+		if i == 0 {
+			result, recorded = groupResult, groupRecorded
+		}
+	}
+
+	if result.Applied != -1 {
+		if err := movement.Record(msg.User, batch.Fixes[result.Applied]); err != nil {
+			logger.Println("controller.error: ", err)
+		}
+	}
+
+	// Older fixes are only kept in the history
+	if history != nil {
+		if err := history.Record(msg.User, recorded); err != nil {
+			logger.Println("controller.error: ", err)
+		}
+	}
+
+	if err := subscriptions.Refresh(msg.User, msg.Receiver); err != nil {
+		logger.Println("controller.error: ", err)
+	}
+
+	if err := geofences.Refresh(msg.User, msg.Receiver); err != nil {
+		logger.Println("controller.error: ", err)
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		logger.Println("controller.error: failed to serialize data")
+
+		return false
+	}
+
+	if err := reply(brokerOut, msg, msg.EventType, string(data)); err != nil {
+		logger.Println("controller.error: upserted batch but failed to send for reason ", err)
+
+		return false
+	}
+
+	logger.Println("controller.success: upserted user location batch")
+
+	return true
+}
+
+// Remove the location of a user from each of the given groups so they are no longer visible there
+func handleRemoveLocation(groups *pUtils.Groups, brokerOut utils.Broker, logger *log.Logger, msg *utils.BrokerMessage) bool {
+	locations, err := groupLocations(groups, msg.Body)
+	if err != nil {
+		logger.Println("controller.error: ", err)
+		replyError(brokerOut, msg, err, logger)
+
+		return true
+	}
+
+	for _, location := range locations {
+		if err := location.Remove(msg.User); err != nil {
+			logger.Println("controller.error: ", err)
+			replyError(brokerOut, msg, err, logger)
+
+			return true
+		}
+	}
+
+	logger.Println("controller.success: removed user location data")
+
+	if err := reply(brokerOut, msg, msg.EventType, ""); err != nil {
+		logger.Println("controller.error: removed location but failed to send for reason ", err)
+	}
+
+	return true
+}
+
+// Find the location stores of the groups named in a message body
+func groupLocations(groups *pUtils.Groups, body string) ([]pUtils.LocationStore, error) {
+	scope, err := pUtils.NewGroupScope(body)
+	if err != nil {
+		return nil, err
+	}
+
+	return groups.Scope(scope)
+}
@@ -0,0 +1,28 @@
+package controller
+
+import (
+	pUtils "github.com/bengosborn/cue/proximity/utils"
+)
+
+// Privacy settings deciding where users are shown to others
+type privacyLookup interface {
+	Get(user string) (*pUtils.PrivacySettings, error)
+	Apply(users []*pUtils.NearbyUser, area *pUtils.QueryArea) ([]*pUtils.NearbyUser, error)
+	Padding() (float64, error)
+}
+
+// Blocks, friends and modes deciding which users a viewer may see
+type visibilityLookup interface {
+	Visible(viewer string, target string) (bool, error)
+	Filter(viewer string, users []*pUtils.NearbyUser) ([]*pUtils.NearbyUser, error)
+}
+
+// Geofence membership of users as they move
+type geofenceUpdater interface {
+	Update(group string, userData *pUtils.UserData) ([]*pUtils.GeofenceTransition, error)
+}
+
+// Subscribers to alert when a user comes near
+type subscriberLookup interface {
+	Affected(group string, userData *pUtils.UserData, lat float64, long float64) ([]*pUtils.NearbyAlert, error)
+}
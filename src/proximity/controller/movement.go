@@ -0,0 +1,47 @@
+package controller
+
+import (
+	"encoding/json"
+	"log"
+
+	pUtils "github.com/bengosborn/cue/proximity/utils"
+	"github.com/bengosborn/cue/utils"
+	"github.com/google/uuid"
+)
+
+// Previous location of a user from any shard which falls back to the local store and is nil for users without one
+func previousLocation(movement *pUtils.MovementPolicy, location pUtils.LocationStore, logger *log.Logger, user string) *pUtils.UserData {
+	prev, err := movement.Previous(user)
+	if err == nil {
+		return prev
+	}
+
+	logger.Println("controller.error: ", err)
+
+	prev, err = location.Get(user)
+	if err != nil {
+		return nil
+	}
+
+	return prev
+}
+
+// Send a security event for impossible movement so spoofing can be detected
+func reportMovement(brokerSecurity utils.Broker, logger *log.Logger, msg *utils.BrokerMessage, violation *pUtils.MovementViolation) {
+	logger.Printf("controller.error: user moved %.0fm at %.0fm/s which exceeds %.0fm/s\n", violation.Distance, violation.Speed, violation.MaxSpeed)
+
+	if brokerSecurity == nil {
+		return
+	}
+
+	data, err := json.Marshal(violation)
+	if err != nil {
+		logger.Println("controller.error: failed to serialize data")
+
+		return
+	}
+
+	if err := brokerSecurity.Send(&utils.BrokerMessage{Id: uuid.NewString(), Receiver: msg.Receiver, User: msg.User, EventType: utils.SecurityImpossibleMovement, Body: string(data)}); err != nil {
+		logger.Println("controller.error: failed to send security event")
+	}
+}
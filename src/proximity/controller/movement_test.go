@@ -0,0 +1,62 @@
+package controller
+
+import (
+	"context"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/bengosborn/cue/helpers"
+	pUtils "github.com/bengosborn/cue/proximity/utils"
+	"github.com/bengosborn/cue/utils"
+	"github.com/google/uuid"
+)
+
+func TestMovementCheckedAcrossShardsWithoutTimestamp(t *testing.T) {
+	client := testRedis(t)
+	ctx := context.Background()
+
+	movement, err := pUtils.NewMovementPolicy(ctx, client, time.Minute, pUtils.MovementReject, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := uuid.NewString()
+	t.Cleanup(func() { client.Del(ctx, helpers.FormatKey("movement:last", user)) })
+
+	// Each shard has its own store so the previous fix is only found through the shared record
+	var stores []pUtils.LocationStore
+	for i := 0; i < 2; i++ {
+		location, err := pUtils.NewLocation(ctx, uuid.NewString(), time.Minute, time.Second, nil, &pUtils.SpatialIndexConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stores = append(stores, location)
+	}
+
+	geofences := pUtils.NewGeofences(ctx, client)
+	subscriptions := pUtils.NewSubscriptions(ctx, client, time.Minute)
+	logger := log.New(io.Discard, "", 0)
+
+	send := func(location pUtils.LocationStore, body string) *captureBroker {
+		brokerOut, brokerSecurity := &captureBroker{}, &captureBroker{}
+		handleSendLocation(pUtils.NewGroups(ctx, client, location, nil), geofences, subscriptions, movement, brokerOut, brokerSecurity, logger, &utils.BrokerMessage{User: user, EventType: utils.ProximitySendLocation, Body: body})
+
+		return brokerSecurity
+	}
+
+	if security := send(stores[0], `{"lat": 37.7749, "long": -122.4194}`); len(security.messages) != 0 {
+		t.Fatal("got a violation for the first fix")
+	}
+
+	// A fix without a timestamp on another shard is stamped and checked against the first fix
+	if security := send(stores[1], `{"lat": 51.5, "long": -0.12}`); len(security.messages) != 1 || security.messages[0].EventType != utils.SecurityImpossibleMovement {
+		t.Fatal("got no violation for an impossible jump between shards")
+	}
+
+	if _, err := stores[1].Get(user); err == nil {
+		t.Fatal("got the rejected fix stored")
+	}
+}
@@ -0,0 +1,72 @@
+package controller
+
+import (
+	"encoding/json"
+	"log"
+
+	pUtils "github.com/bengosborn/cue/proximity/utils"
+	"github.com/bengosborn/cue/utils"
+)
+
+// Store the privacy settings of the user
+func handleSetPrivacy(privacy *pUtils.Privacy, brokerOut utils.Broker, logger *log.Logger, msg *utils.BrokerMessage) bool {
+	settings, err := pUtils.NewPrivacySettings(msg.Body)
+	if err != nil {
+		logger.Println("controller.error: invalid privacy settings")
+		replyError(brokerOut, msg, err, logger)
+
+		return true
+	}
+
+	if err := privacy.Set(msg.User, settings); err != nil {
+		logger.Println("controller.error: ", err)
+		replyError(brokerOut, msg, err, logger)
+
+		return false
+	}
+
+	data, err := json.Marshal(settings)
+	if err != nil {
+		logger.Println("controller.error: failed to serialize data")
+
+		return false
+	}
+
+	if err := reply(brokerOut, msg, msg.EventType, string(data)); err != nil {
+		logger.Println("controller.error: stored privacy settings but failed to send for reason ", err)
+
+		return false
+	}
+
+	logger.Println("controller.success: stored privacy settings")
+
+	return true
+}
+
+// Reply with the privacy settings of the user
+func handleGetPrivacy(privacy *pUtils.Privacy, brokerOut utils.Broker, logger *log.Logger, msg *utils.BrokerMessage) bool {
+	settings, err := privacy.Get(msg.User)
+	if err != nil {
+		logger.Println("controller.error: ", err)
+		replyError(brokerOut, msg, err, logger)
+
+		return false
+	}
+
+	data, err := json.Marshal(settings)
+	if err != nil {
+		logger.Println("controller.error: failed to serialize data")
+
+		return false
+	}
+
+	if err := reply(brokerOut, msg, msg.EventType, string(data)); err != nil {
+		logger.Println("controller.error: retrieved privacy settings but failed to send for reason ", err)
+
+		return false
+	}
+
+	logger.Println("controller.success: retrieved privacy settings")
+
+	return true
+}
@@ -0,0 +1,477 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bengosborn/cue/helpers"
+	pUtils "github.com/bengosborn/cue/proximity/utils"
+	"github.com/bengosborn/cue/utils"
+	"github.com/redis/go-redis/v9"
+)
+
+// Broker which keeps every message sent through it
+type captureBroker struct {
+	mutex    sync.Mutex
+	messages []*utils.BrokerMessage
+}
+
+func (c *captureBroker) Listen(fn func(*utils.BrokerMessage) bool, lock *utils.ResourceLockDistributed) error {
+	return nil
+}
+
+func (c *captureBroker) Send(msg *utils.BrokerMessage) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.messages = append(c.messages, msg)
+
+	return nil
+}
+
+// Connect to the redis at REDIS_URL or skip the test when none is reachable
+func testRedis(t *testing.T) *redis.Client {
+	t.Helper()
+
+	url := os.Getenv("REDIS_URL")
+	if url == "" {
+		t.Skip("REDIS_URL is not set")
+	}
+
+	client, err := helpers.NewRedis(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		t.Skipf("redis is not reachable: %v", err)
+	}
+
+	t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+// Privacy settings kept in memory where users without settings share their exact location
+type memoryPrivacy map[string]*pUtils.PrivacySettings
+
+func (m memoryPrivacy) Get(user string) (*pUtils.PrivacySettings, error) {
+	if settings, ok := m[user]; ok {
+		return settings, nil
+	}
+
+	return &pUtils.PrivacySettings{}, nil
+}
+
+func (m memoryPrivacy) Apply(users []*pUtils.NearbyUser, area *pUtils.QueryArea) ([]*pUtils.NearbyUser, error) {
+	settings := make([]*pUtils.PrivacySettings, len(users))
+	for i, user := range users {
+		settings[i], _ = m.Get(user.Data.User)
+	}
+
+	return pUtils.ShowUsers(users, settings, area)
+}
+
+func (m memoryPrivacy) Padding() (float64, error) {
+	padding := 0.0
+	for _, settings := range m {
+		if settings.CoarseOnly {
+			padding = math.Max(padding, pUtils.CoarseGridSize)
+		}
+
+		padding = math.Max(padding, settings.FuzzRadius)
+	}
+
+	return padding, nil
+}
+
+// Visibility where everyone may see everyone
+type memoryVisibility struct{}
+
+func (memoryVisibility) Visible(viewer string, target string) (bool, error) {
+	return true, nil
+}
+
+func (memoryVisibility) Filter(viewer string, users []*pUtils.NearbyUser) ([]*pUtils.NearbyUser, error) {
+	return users, nil
+}
+
+// Geofences kept in memory which remember where each user was matched and report entering every geofence containing them
+type memoryGeofences struct {
+	fences  []*pUtils.Geofence
+	matched map[string]*pUtils.UserData
+}
+
+func (m *memoryGeofences) Update(group string, userData *pUtils.UserData) ([]*pUtils.GeofenceTransition, error) {
+	m.matched[userData.User] = userData
+
+	transitions := make([]*pUtils.GeofenceTransition, 0)
+	for _, fence := range m.fences {
+		if fence.Group == group && fence.Contains(userData.Lat, userData.Long) {
+			transitions = append(transitions, &pUtils.GeofenceTransition{Geofence: fence, Entered: true})
+		}
+	}
+
+	return transitions, nil
+}
+
+// Subscribers kept in memory which remember where each user was matched
+type memorySubscriptions struct {
+	subscribers map[string]*pUtils.Subscription
+	positions   map[string]*pUtils.Point
+	matched     map[string]*pUtils.Point
+}
+
+func (m *memorySubscriptions) Affected(group string, userData *pUtils.UserData, lat float64, long float64) ([]*pUtils.NearbyAlert, error) {
+	m.matched[userData.User] = &pUtils.Point{Lat: lat, Long: long}
+
+	alerts := make([]*pUtils.NearbyAlert, 0)
+	for user, subscription := range m.subscribers {
+		position := m.positions[user]
+
+		if distance := pUtils.Haversine(position.Lat, position.Long, lat, long); user != userData.User && distance <= subscription.Radius {
+			alerts = append(alerts, &pUtils.NearbyAlert{Subscription: subscription, User: userData.User, Distance: math.Round(distance), Timestamp: userData.Timestamp})
+		}
+	}
+
+	return alerts, nil
+}
+
+// Parse privacy settings or fail the test
+func privacySettings(t *testing.T, body string) *pUtils.PrivacySettings {
+	t.Helper()
+
+	settings, err := pUtils.NewPrivacySettings(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return settings
+}
+
+// Fail when a message body holds the exact coordinates of a user who does not share them
+func checkNoExactCoordinates(t *testing.T, msg *utils.BrokerMessage, exact map[string]*pUtils.UserData, privacy memoryPrivacy) {
+	t.Helper()
+
+	for user, fix := range exact {
+		if _, ok := privacy[user]; !ok {
+			continue
+		}
+
+		for _, value := range []float64{fix.Lat, fix.Long} {
+			if strings.Contains(msg.Body, strconv.FormatFloat(value, 'f', -1, 64)) {
+				t.Fatalf("event %d sent the exact coordinate %f of user %s", msg.EventType, value, user)
+			}
+		}
+	}
+}
+
+func TestAreaRepliesNeverSendExactCoordinates(t *testing.T) {
+	location, err := pUtils.NewLocation(context.Background(), "test", time.Minute, time.Second, nil, &pUtils.SpatialIndexConfig{Depth: pUtils.MaxPartitionDepth})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	groups := pUtils.NewGroups(context.Background(), nil, location, nil)
+	logger := log.New(io.Discard, "", 0)
+
+	exact := map[string]*pUtils.UserData{
+		"viewer": {Lat: 37.774912, Long: -122.419415},
+		"fuzzed": {Lat: 37.780137, Long: -122.410271},
+		"coarse": {Lat: 37.770413, Long: -122.430158},
+		"hidden": {Lat: 37.776391, Long: -122.417236},
+	}
+
+	privacy := memoryPrivacy{
+		"fuzzed": privacySettings(t, `{"fuzzRadius": 500}`),
+		"coarse": privacySettings(t, `{"coarseOnly": true}`),
+		"hidden": privacySettings(t, `{"hiddenZones": [{"lat": 37.7764, "long": -122.4172, "radius": 300}]}`),
+	}
+
+	for user, fix := range exact {
+		if err := location.Upsert(user, fix); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	brokerOut := &captureBroker{}
+	for _, msg := range []*utils.BrokerMessage{
+		{User: "viewer", EventType: utils.ProximityRequestNearby, Body: `{"radius": 50000}`},
+		{User: "viewer", EventType: utils.ProximityRequestBox, Body: `{"minLat": 37.7, "minLong": -122.5, "maxLat": 37.8, "maxLong": -122.4}`},
+		{User: "viewer", EventType: utils.ProximityRequestPolygon, Body: `{"points": [{"lat": 37.7, "long": -122.5}, {"lat": 37.85, "long": -122.5}, {"lat": 37.85, "long": -122.35}]}`},
+	} {
+		handled := false
+		switch msg.EventType {
+		case utils.ProximityRequestNearby:
+			handled = handleNearby(groups, memoryVisibility{}, privacy, brokerOut, logger, msg)
+		case utils.ProximityRequestBox:
+			handled = handleBox(groups, memoryVisibility{}, privacy, brokerOut, logger, msg)
+		case utils.ProximityRequestPolygon:
+			handled = handlePolygon(groups, memoryVisibility{}, privacy, brokerOut, logger, msg)
+		}
+
+		if !handled {
+			t.Fatalf("event %d was not handled", msg.EventType)
+		}
+	}
+
+	if len(brokerOut.messages) != 3 {
+		t.Fatalf("got %d replies, want 3", len(brokerOut.messages))
+	}
+
+	for _, msg := range brokerOut.messages {
+		if msg.EventType == utils.Error {
+			t.Fatalf("got error reply %s", msg.Body)
+		}
+
+		checkNoExactCoordinates(t, msg, exact, privacy)
+
+		response := &pUtils.NearbyResponse{}
+		if err := json.Unmarshal([]byte(msg.Body), response); err != nil {
+			t.Fatal(err)
+		}
+
+		shown := make(map[string]bool)
+		for _, user := range response.Users {
+			shown[user.User] = true
+
+			if user.User == "hidden" {
+				t.Fatalf("event %d sent a user inside their hidden zone", msg.EventType)
+			}
+
+			setting, ok := privacy[user.User]
+			if !ok {
+				continue
+			}
+
+			// Only the rounded shown position is sent
+			fix := exact[user.User]
+			lat, long := setting.Position(fix.Lat, fix.Long)
+
+			if user.Lat != math.Round(lat*100)/100 || user.Long != math.Round(long*100)/100 {
+				t.Fatalf("event %d sent user %s at %f, %f rather than where they are shown at %f, %f", msg.EventType, user.User, user.Lat, user.Long, lat, long)
+			}
+
+			if user.Accuracy != nil || user.Altitude != nil {
+				t.Fatalf("event %d sent readings for user %s", msg.EventType, user.User)
+			}
+
+			if user.User == "coarse" && len(user.Partition) > pUtils.CoarsePartitionDepth {
+				t.Fatalf("event %d sent a partition of depth %d for a coarse user", msg.EventType, len(user.Partition))
+			}
+
+			// Nearby distances are measured from the shown position
+			if msg.EventType == utils.ProximityRequestNearby {
+				want := setting.Distance(pUtils.Haversine(exact["viewer"].Lat, exact["viewer"].Long, lat, long))
+				if user.Distance != math.Round(want) {
+					t.Fatalf("got distance %f for user %s, want %f", user.Distance, user.User, want)
+				}
+			}
+		}
+
+		if msg.EventType == utils.ProximityRequestNearby && (!shown["fuzzed"] || !shown["coarse"]) {
+			t.Fatalf("got users %v nearby, want the fuzzed and coarse users", shown)
+		}
+	}
+}
+
+func TestNotificationsNeverUseExactCoordinates(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	now := time.Now()
+
+	exact := map[string]*pUtils.UserData{
+		"exact":  {User: "exact", Lat: 37.774912, Long: -122.419415, Timestamp: now},
+		"fuzzed": {User: "fuzzed", Lat: 37.774912, Long: -122.419415, Timestamp: now},
+		"coarse": {User: "coarse", Lat: 37.774912, Long: -122.419415, Timestamp: now},
+		"hidden": {User: "hidden", Lat: 37.774912, Long: -122.419415, Timestamp: now},
+	}
+
+	privacy := memoryPrivacy{
+		"fuzzed": privacySettings(t, `{"fuzzRadius": 500}`),
+		"coarse": privacySettings(t, `{"coarseOnly": true}`),
+		"hidden": privacySettings(t, `{"hiddenZones": [{"lat": 37.7749, "long": -122.4194, "radius": 500}]}`),
+	}
+
+	// The geofence only contains the exact position
+	fence, err := pUtils.NewGeofence(`{"name": "block", "lat": 37.774912, "long": -122.419415, "radius": 100}`, "owner", "receiver")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, user := range []string{"fuzzed", "coarse"} {
+		if lat, long := privacy[user].Position(exact[user].Lat, exact[user].Long); fence.Contains(lat, long) {
+			t.Fatalf("the position shown for user %s is inside the geofence", user)
+		}
+	}
+
+	geofences := &memoryGeofences{fences: []*pUtils.Geofence{fence}, matched: make(map[string]*pUtils.UserData)}
+	subscriptions := &memorySubscriptions{
+		subscribers: map[string]*pUtils.Subscription{"watcher": {User: "watcher", Receiver: "receiver", Radius: 20000}},
+		positions:   map[string]*pUtils.Point{"watcher": {Lat: 37.80, Long: -122.40}},
+		matched:     make(map[string]*pUtils.Point),
+	}
+
+	brokerOut := &captureBroker{}
+
+	for _, fix := range exact {
+		notifyGeofences("", geofences, memoryVisibility{}, privacy, brokerOut, logger)(fix)
+		notifyNearby("", subscriptions, memoryVisibility{}, privacy, brokerOut, logger)(fix)
+	}
+
+	// Every user is matched where they are shown and users inside a hidden zone are never matched
+	for user, fix := range exact {
+		settings, _ := privacy.Get(user)
+		lat, long := settings.Position(fix.Lat, fix.Long)
+
+		matched, ok := geofences.matched[user]
+		if user == "hidden" {
+			if ok || subscriptions.matched[user] != nil {
+				t.Fatal("got a user inside their hidden zone matched")
+			}
+
+			continue
+		}
+
+		if !ok || matched.Lat != lat || matched.Long != long {
+			t.Fatalf("got user %s matched against geofences at %+v rather than %f, %f", user, matched, lat, long)
+		}
+
+		if point := subscriptions.matched[user]; point == nil || point.Lat != lat || point.Long != long {
+			t.Fatalf("got user %s matched against subscribers at %+v rather than %f, %f", user, point, lat, long)
+		}
+	}
+
+	entered, alerted := 0, make(map[string]bool)
+
+	for _, msg := range brokerOut.messages {
+		checkNoExactCoordinates(t, msg, exact, privacy)
+
+		// Neither payload carries a position
+		fields := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(msg.Body), &fields); err != nil {
+			t.Fatal(err)
+		}
+
+		for field := range fields {
+			if field != "geofence" && field != "name" && field != "user" && field != "distance" && field != "timestamp" {
+				t.Fatalf("event %d sent the field %s", msg.EventType, field)
+			}
+		}
+
+		switch msg.EventType {
+		case utils.ProximityGeofenceEnter:
+			event := &pUtils.GeofenceEvent{}
+			if err := json.Unmarshal([]byte(msg.Body), event); err != nil {
+				t.Fatal(err)
+			}
+
+			if event.User != "exact" {
+				t.Fatalf("got a geofence event for user %s who is shown outside the geofence", event.User)
+			}
+
+			entered++
+
+		case utils.ProximityNearbyAlert:
+			alert := &pUtils.NearbyAlert{}
+			if err := json.Unmarshal([]byte(msg.Body), alert); err != nil {
+				t.Fatal(err)
+			}
+
+			// Distances are measured to where the user is shown and rounded to their grid
+			settings, _ := privacy.Get(alert.User)
+			lat, long := settings.Position(exact[alert.User].Lat, exact[alert.User].Long)
+			want := settings.Distance(math.Round(pUtils.Haversine(37.80, -122.40, lat, long)))
+
+			if alert.Distance != want {
+				t.Fatalf("got distance %f for user %s, want %f", alert.Distance, alert.User, want)
+			}
+
+			alerted[alert.User] = true
+
+		default:
+			t.Fatalf("got unexpected event %d", msg.EventType)
+		}
+	}
+
+	if entered != 1 || len(alerted) != 3 || alerted["hidden"] {
+		t.Fatalf("got %d geofence events and alerts for %v", entered, alerted)
+	}
+}
+
+func TestSmallQueriesAreNotTruncated(t *testing.T) {
+	location, err := pUtils.NewLocation(context.Background(), "test", time.Minute, time.Second, nil, &pUtils.SpatialIndexConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	groups := pUtils.NewGroups(context.Background(), nil, location, nil)
+	logger := log.New(io.Discard, "", 0)
+	rng := rand.New(rand.NewSource(9))
+
+	lat, long := 37.774912, -122.419415
+	if err := location.Upsert("viewer", &pUtils.UserData{Lat: lat, Long: long}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A dense city holds more users within the largest privacy grid than a page may scan
+	near := make(map[string]bool)
+	for i := 0; i < 3*pUtils.MaxPageScan; i++ {
+		user := strconv.Itoa(i)
+		distance := 100 + rng.Float64()*(pUtils.PrivacyPadding-100)
+
+		if i < 20 {
+			distance = rng.Float64() * 90
+			near[user] = true
+		}
+
+		bearing := rng.Float64() * 2 * math.Pi
+		userLat := lat + distance*math.Cos(bearing)/111320
+		userLong := long + distance*math.Sin(bearing)/(111320*math.Cos(lat*math.Pi/180))
+
+		if err := location.Upsert(user, &pUtils.UserData{Lat: userLat, Long: userLong}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only a small fuzz grid is in use so the query is not widened by the largest grid
+	privacy := memoryPrivacy{"0": privacySettings(t, `{"fuzzRadius": 50}`)}
+
+	brokerOut := &captureBroker{}
+	if !handleNearby(groups, memoryVisibility{}, privacy, brokerOut, logger, &utils.BrokerMessage{User: "viewer", EventType: utils.ProximityRequestNearby, Body: `{"radius": 100, "limit": 100}`}) {
+		t.Fatal("nearby was not handled")
+	}
+
+	response := &pUtils.NearbyResponse{}
+	if err := json.Unmarshal([]byte(brokerOut.messages[0].Body), response); err != nil {
+		t.Fatal(err)
+	}
+
+	found := make(map[string]bool)
+	for _, user := range response.Users {
+		found[user.User] = true
+	}
+
+	for user := range near {
+		if !found[user] {
+			t.Fatalf("got %d users without user %s who is within the radius", len(response.Users), user)
+		}
+	}
+
+	if response.Cursor != "" {
+		t.Fatalf("got a cursor %s for a page which was not truncated", response.Cursor)
+	}
+}
@@ -0,0 +1,56 @@
+package controller
+
+import (
+	"encoding/json"
+	"log"
+
+	pUtils "github.com/bengosborn/cue/proximity/utils"
+	"github.com/bengosborn/cue/utils"
+)
+
+// Send a reply to the receiver of a message
+func reply(brokerOut utils.Broker, msg *utils.BrokerMessage, eventType utils.EventType, body string) error {
+	return brokerOut.Send(&utils.BrokerMessage{Id: msg.Id, Receiver: msg.Receiver, User: msg.User, EventType: eventType, Body: body})
+}
+
+// Send an error reply to the receiver of a message
+func replyError(brokerOut utils.Broker, msg *utils.BrokerMessage, err error, logger *log.Logger) {
+	if err := reply(brokerOut, msg, utils.Error, err.Error()); err != nil {
+		logger.Println("controller.error: failed to send message")
+	}
+}
+
+// Send a page of the users the receiver of a message may see as they choose to be shown inside the area
+func replyUsers(brokerOut utils.Broker, visibility visibilityLookup, privacy privacyLookup, msg *utils.BrokerMessage, query *pUtils.PageQuery, area *pUtils.QueryArea, users []*pUtils.NearbyUser, logger *log.Logger) bool {
+	// Visibility and privacy are only looked up for the candidates of the page
+	page, cursor, err := query.Page(users, func(candidates []*pUtils.NearbyUser) ([]*pUtils.NearbyUser, error) {
+		visible, err := visibility.Filter(msg.User, candidates)
+		if err != nil {
+			return nil, err
+		}
+
+		return privacy.Apply(visible, area)
+	})
+	if err != nil {
+		logger.Println("controller.error: ", err)
+		replyError(brokerOut, msg, err, logger)
+
+		return false
+	}
+
+	data, err := json.Marshal(pUtils.NewNearbyResponse(page, cursor))
+	if err != nil {
+		logger.Println("controller.error: failed to serialize data")
+		replyError(brokerOut, msg, err, logger)
+
+		return false
+	}
+
+	if err := reply(brokerOut, msg, msg.EventType, string(data)); err != nil {
+		logger.Println("controller.error: retrieved users but failed to send for reason ", err)
+
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,163 @@
+package controller
+
+import (
+	"encoding/json"
+	"log"
+
+	pUtils "github.com/bengosborn/cue/proximity/utils"
+	"github.com/bengosborn/cue/utils"
+)
+
+// Find the shard which owns a message where messages for any shard or for groups other than the sharded default group report false
+func shardOwner(sharded *pUtils.ShardedLocation, msg *utils.BrokerMessage) (int, bool) {
+	switch msg.EventType {
+	case utils.ProximitySendLocation:
+		userData := &pUtils.UserData{}
+		if err := json.Unmarshal([]byte(msg.Body), userData); err != nil {
+			return 0, false
+		}
+
+		if scope, err := pUtils.NewGroupScope(msg.Body); err != nil || len(scope.Groups) > 0 {
+			return 0, false
+		}
+
+		shard, err := sharded.Owner(userData.Lat, userData.Long)
+
+		return shard, err == nil
+
+	case utils.ProximitySendLocationBatch:
+		// Batches are either a list of fixes or an object with the groups and fixes
+		batch, err := pUtils.NewGroupBatch(msg.Body)
+		if err != nil || len(batch.Groups) > 0 {
+			return 0, false
+		}
+
+		// The newest fix decides where the user is stored
+		var newest *pUtils.UserData
+		for _, fix := range batch.Fixes {
+			if fix != nil && (newest == nil || fix.Timestamp.After(newest.Timestamp)) {
+				newest = fix
+			}
+		}
+
+		if newest == nil {
+			return 0, false
+		}
+
+		shard, err := sharded.Owner(newest.Lat, newest.Long)
+
+		return shard, err == nil
+
+	case utils.ProximityRemoveLocation:
+		if scope, err := pUtils.NewGroupScope(msg.Body); err != nil || len(scope.Groups) > 0 {
+			return 0, false
+		}
+
+		shard, err := sharded.OwnerOf(msg.User)
+
+		return shard, err == nil
+
+	case utils.ProximityRequestNearby:
+		if query, err := pUtils.NewNearbyQuery(msg.Body); err != nil || query.Group != "" {
+			return 0, false
+		}
+
+		shard, err := sharded.OwnerOf(msg.User)
+
+		return shard, err == nil
+
+	// Box and polygon queries need the location of the user to check they are a member
+	case utils.ProximityRequestBox:
+		if query, err := pUtils.NewBoxQuery(msg.Body); err != nil || query.Group != "" {
+			return 0, false
+		}
+
+		shard, err := sharded.OwnerOf(msg.User)
+
+		return shard, err == nil
+
+	case utils.ProximityRequestPolygon:
+		if query, err := pUtils.NewPolygonQuery(msg.Body); err != nil || query.Group != "" {
+			return 0, false
+		}
+
+		shard, err := sharded.OwnerOf(msg.User)
+
+		return shard, err == nil
+
+	// Geofences need the location of the owner to check they are a member
+	case utils.ProximityCreateGeofence:
+		if fence, err := pUtils.NewGeofence(msg.Body, msg.User, msg.Receiver); err != nil || fence.Group != "" {
+			return 0, false
+		}
+
+		shard, err := sharded.OwnerOf(msg.User)
+
+		return shard, err == nil
+
+	default:
+		return 0, false
+	}
+}
+
+// Forward a message to the shard which owns it and report whether it was forwarded
+func routeShard(sharded *pUtils.ShardedLocation, logger *log.Logger, msg *utils.BrokerMessage) bool {
+	shard, ok := shardOwner(sharded, msg)
+	if !ok || sharded.Owns(shard) {
+		return false
+	}
+
+	if err := sharded.Forward(shard, msg); err != nil {
+		logger.Println("controller.error: ", err)
+
+		return false
+	}
+
+	logger.Println("controller.success: forwarded message to shard ", shard)
+
+	return true
+}
+
+// Answer a query from another shard
+func handleShardQuery(sharded *pUtils.ShardedLocation, logger *log.Logger, msg *utils.BrokerMessage) bool {
+	if err := sharded.Respond(msg.Body); err != nil {
+		logger.Println("controller.error: ", err)
+
+		return false
+	}
+
+	logger.Println("controller.success: answered shard query")
+
+	return true
+}
+
+// Pass the result of a shard query to the waiting request
+func handleShardResult(sharded *pUtils.ShardedLocation, logger *log.Logger, msg *utils.BrokerMessage) bool {
+	if err := sharded.Resolve(msg.Body); err != nil {
+		logger.Println("controller.error: ", err)
+	}
+
+	return true
+}
+
+// Remove a user who moved to another shard
+func handleShardRelease(sharded *pUtils.ShardedLocation, logger *log.Logger, msg *utils.BrokerMessage) bool {
+	if err := sharded.Release(msg.Body); err != nil {
+		logger.Println("controller.error: ", err)
+
+		return true
+	}
+
+	logger.Println("controller.success: released user to another shard")
+
+	return true
+}
+
+// Claim upserted users for this shard
+func claimShard(sharded *pUtils.ShardedLocation, logger *log.Logger) func(*pUtils.UserData) {
+	return func(userData *pUtils.UserData) {
+		if err := sharded.Claim(userData); err != nil {
+			logger.Println("controller.error: ", err)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pUtils "github.com/bengosborn/cue/proximity/utils"
+	"github.com/bengosborn/cue/utils"
+)
+
+func TestShardOwnerBatch(t *testing.T) {
+	location, err := pUtils.NewLocation(context.Background(), "test", time.Minute, time.Second, nil, &pUtils.SpatialIndexConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sharded, err := pUtils.NewShardedLocation(context.Background(), location, nil, "proximity", 0, 4, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := sharded.Owner(37.7749, -122.4194)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fixes := `[{"lat": 51.5, "long": -0.12, "timestamp": "2023-06-27T10:29:00Z"}, {"lat": 37.7749, "long": -122.4194, "timestamp": "2023-06-27T10:30:00Z"}]`
+
+	tests := []struct {
+		eventType utils.EventType
+		body      string
+		routed    bool
+	}{
+		{utils.ProximitySendLocation, `{"lat": 37.7749, "long": -122.4194}`, true},
+		{utils.ProximitySendLocation, `{"lat": 37.7749, "long": -122.4194, "groups": ["hikers"]}`, false},
+		{utils.ProximitySendLocationBatch, fixes, true},
+		{utils.ProximitySendLocationBatch, `{"fixes": ` + fixes + `}`, true},
+		{utils.ProximitySendLocationBatch, `{"groups": [], "fixes": ` + fixes + `}`, true},
+		{utils.ProximitySendLocationBatch, `{"groups": ["hikers"], "fixes": ` + fixes + `}`, false},
+		{utils.ProximitySendLocationBatch, `{"fixes": []}`, false},
+		{utils.ProximityRequestNearby, `{"group": "hikers"}`, false},
+		{utils.ProximityRequestBox, `{"minLat": 37.7, "minLong": -122.5, "maxLat": 37.8, "maxLong": -122.4, "group": "hikers"}`, false},
+		{utils.ProximityRequestPolygon, `{"points": [{"lat": 37.7, "long": -122.5}, {"lat": 37.8, "long": -122.5}, {"lat": 37.8, "long": -122.4}], "group": "hikers"}`, false},
+	}
+
+	for _, test := range tests {
+		shard, ok := shardOwner(sharded, &utils.BrokerMessage{User: "a", EventType: test.eventType, Body: test.body})
+		if ok != test.routed {
+			t.Fatalf("event %d with body %s: got routed %t, want %t", test.eventType, test.body, ok, test.routed)
+		}
+
+		if ok && shard != want {
+			t.Fatalf("event %d with body %s: got shard %d, want %d", test.eventType, test.body, shard, want)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package controller
+
+import (
+	"encoding/json"
+	"log"
+
+	pUtils "github.com/bengosborn/cue/proximity/utils"
+	"github.com/bengosborn/cue/utils"
+	"github.com/google/uuid"
+)
+
+// Subscribe the user to alerts when others come near
+func handleSubscribeNearby(subscriptions *pUtils.Subscriptions, brokerOut utils.Broker, logger *log.Logger, msg *utils.BrokerMessage) bool {
+	subscription, err := pUtils.NewSubscription(msg.Body, msg.User, msg.Receiver)
+	if err != nil {
+		logger.Println("controller.error: invalid subscription")
+		replyError(brokerOut, msg, err, logger)
+
+		return true
+	}
+
+	if err := subscriptions.Subscribe(subscription); err != nil {
+		logger.Println("controller.error: ", err)
+		replyError(brokerOut, msg, err, logger)
+
+		return false
+	}
+
+	if err := reply(brokerOut, msg, msg.EventType, ""); err != nil {
+		logger.Println("controller.error: subscribed but failed to send for reason ", err)
+
+		return false
+	}
+
+	logger.Println("controller.success: subscribed to nearby alerts")
+
+	return true
+}
+
+// Unsubscribe the user from nearby alerts
+func handleUnsubscribeNearby(subscriptions *pUtils.Subscriptions, brokerOut utils.Broker, logger *log.Logger, msg *utils.BrokerMessage) bool {
+	if err := subscriptions.Unsubscribe(msg.User); err != nil {
+		logger.Println("controller.error: ", err)
+		replyError(brokerOut, msg, err, logger)
+
+		return false
+	}
+
+	if err := reply(brokerOut, msg, msg.EventType, ""); err != nil {
+		logger.Println("controller.error: unsubscribed but failed to send for reason ", err)
+
+		return false
+	}
+
+	logger.Println("controller.success: unsubscribed from nearby alerts")
+
+	return true
+}
+
+// Alert subscribers in the same group when a user comes within their radius
+func notifyNearby(group string, subscriptions subscriberLookup, visibility visibilityLookup, privacy privacyLookup, brokerOut utils.Broker, logger *log.Logger) func(*pUtils.UserData) {
+	return func(userData *pUtils.UserData) {
+		// Users inside a hidden zone never trigger alerts
+		settings, err := privacy.Get(userData.User)
+		if err != nil {
+			logger.Println("controller.error: ", err)
+
+			return
+		}
+
+		if settings.Hidden(userData.Lat, userData.Long) {
+			return
+		}
+
+		// Subscribers measure their radius to where the user is shown
+		lat, long := settings.Position(userData.Lat, userData.Long)
+
+		alerts, err := subscriptions.Affected(group, userData, lat, long)
+		if err != nil {
+			logger.Println("controller.error: ", err)
+
+			return
+		}
+
+		for _, alert := range alerts {
+			// Subscribers only hear about users they may see
+			if visible, err := visibility.Visible(alert.Subscription.User, userData.User); err != nil || !visible {
+				continue
+			}
+
+			alert.Distance = settings.Distance(alert.Distance)
+
+			data, err := json.Marshal(alert)
+			if err != nil {
+				logger.Println("controller.error: failed to serialize data")
+
+				continue
+			}
+
+			if err := brokerOut.Send(&utils.BrokerMessage{Id: uuid.NewString(), Receiver: alert.Subscription.Receiver, User: alert.Subscription.User, EventType: utils.ProximityNearbyAlert, Body: string(data)}); err != nil {
+				logger.Println("controller.error: failed to send message")
+
+				continue
+			}
+
+			logger.Println("controller.success: sent nearby alert")
+		}
+	}
+}
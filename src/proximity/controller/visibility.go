@@ -0,0 +1,81 @@
+package controller
+
+import (
+	"encoding/json"
+	"log"
+
+	pUtils "github.com/bengosborn/cue/proximity/utils"
+	"github.com/bengosborn/cue/utils"
+)
+
+// Reply with the visibility settings of the user
+func replyVisibility(visibility *pUtils.Visibility, brokerOut utils.Broker, logger *log.Logger, msg *utils.BrokerMessage) bool {
+	settings, err := visibility.Get(msg.User)
+	if err != nil {
+		logger.Println("controller.error: ", err)
+		replyError(brokerOut, msg, err, logger)
+
+		return false
+	}
+
+	data, err := json.Marshal(settings)
+	if err != nil {
+		logger.Println("controller.error: failed to serialize data")
+
+		return false
+	}
+
+	if err := reply(brokerOut, msg, msg.EventType, string(data)); err != nil {
+		logger.Println("controller.error: retrieved visibility settings but failed to send for reason ", err)
+
+		return false
+	}
+
+	logger.Println("controller.success: retrieved visibility settings")
+
+	return true
+}
+
+// Block, unblock, befriend or unfriend another user
+func handleVisibilityTarget(visibility *pUtils.Visibility, update func(string, string) error, brokerOut utils.Broker, logger *log.Logger, msg *utils.BrokerMessage) bool {
+	target, err := pUtils.NewVisibilityTarget(msg.Body, msg.User)
+	if err != nil {
+		logger.Println("controller.error: invalid visibility target")
+		replyError(brokerOut, msg, err, logger)
+
+		return true
+	}
+
+	if err := update(msg.User, target.User); err != nil {
+		logger.Println("controller.error: ", err)
+		replyError(brokerOut, msg, err, logger)
+
+		return true
+	}
+
+	logger.Println("controller.success: updated visibility")
+
+	return replyVisibility(visibility, brokerOut, logger, msg)
+}
+
+// Set who can see the user
+func handleSetVisibility(visibility *pUtils.Visibility, brokerOut utils.Broker, logger *log.Logger, msg *utils.BrokerMessage) bool {
+	mode, err := pUtils.NewVisibilityMode(msg.Body)
+	if err != nil {
+		logger.Println("controller.error: invalid visibility mode")
+		replyError(brokerOut, msg, err, logger)
+
+		return true
+	}
+
+	if err := visibility.SetMode(msg.User, mode); err != nil {
+		logger.Println("controller.error: ", err)
+		replyError(brokerOut, msg, err, logger)
+
+		return false
+	}
+
+	logger.Println("controller.success: set visibility mode")
+
+	return replyVisibility(visibility, brokerOut, logger, msg)
+}
@@ -2,8 +2,12 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/bengosborn/cue/helpers"
@@ -11,14 +15,125 @@ import (
 	pUtils "github.com/bengosborn/cue/proximity/utils"
 	"github.com/bengosborn/cue/utils"
 	"github.com/joho/godotenv"
+	"github.com/redis/go-redis/v9"
 )
 
 const (
 	lockTimeout     = 5 * time.Minute
 	locationTimeout = 5 * time.Minute
+	locationSkew    = 30 * time.Second
 	serviceId       = "proximity:main"
 )
 
+// Read the spatial index config from the environment
+func spatialIndexConfig() (*pUtils.SpatialIndexConfig, error) {
+	config := &pUtils.SpatialIndexConfig{Name: os.Getenv("PROXIMITY_SPATIAL_INDEX")}
+
+	if value := os.Getenv("PROXIMITY_PARTITION_DEPTH"); value != "" {
+		depth, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Depth = uint(depth)
+	}
+
+	if value := os.Getenv("PROXIMITY_PARTITION_LEVELS"); value != "" {
+		levels, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Levels = levels
+	}
+
+	return config, nil
+}
+
+// Read the maximum client clock skew from the environment
+func maxClockSkew() (time.Duration, error) {
+	value := os.Getenv("PROXIMITY_MAX_CLOCK_SKEW")
+	if value == "" {
+		return locationSkew, nil
+	}
+
+	return time.ParseDuration(value)
+}
+
+// Create the optional location history from the environment which is disabled without a retention
+func locationHistory(ctx context.Context, redis *redis.Client) (*pUtils.History, error) {
+	value := os.Getenv("PROXIMITY_HISTORY_RETENTION")
+	if value == "" {
+		return nil, nil
+	}
+
+	retention, err := time.ParseDuration(value)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := int64(pUtils.DefaultHistoryLimit)
+	if value := os.Getenv("PROXIMITY_HISTORY_LIMIT"); value != "" {
+		limit, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return pUtils.NewHistory(ctx, redis, retention, limit)
+}
+
+// Read the policy for impossible movement from the environment
+func movementPolicy(ctx context.Context, redis *redis.Client) (*pUtils.MovementPolicy, error) {
+	maxSpeed := 0.0
+	if value := os.Getenv("PROXIMITY_MAX_SPEED"); value != "" {
+		speed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		maxSpeed = speed
+	}
+
+	return pUtils.NewMovementPolicy(ctx, redis, locationTimeout, os.Getenv("PROXIMITY_MOVEMENT_POLICY"), maxSpeed)
+}
+
+// Create the location store from the environment where a shard count splits the users between instances
+func locationStore(ctx context.Context, redis *redis.Client, skew time.Duration, config *pUtils.SpatialIndexConfig) (pUtils.LocationStore, error) {
+	value := os.Getenv("PROXIMITY_SHARD_COUNT")
+	if value == "" {
+		return pUtils.NewLocationStore(ctx, os.Getenv("PROXIMITY_LOCATION_STORE"), serviceId, locationTimeout, skew, redis, config)
+	}
+
+	count, err := strconv.Atoi(value)
+	if err != nil {
+		return nil, err
+	}
+
+	shard, err := strconv.Atoi(os.Getenv("PROXIMITY_SHARD"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the in memory store is split as the redis store is already shared
+	if name := os.Getenv("PROXIMITY_LOCATION_STORE"); name != "" && name != pUtils.LocationStoreMemory {
+		return nil, errors.New("sharding requires the memory location store")
+	}
+
+	// Replicas of a shard sync with each other
+	location, err := pUtils.NewLocation(ctx, helpers.FormatKey(serviceId, "shard", strconv.Itoa(shard)), locationTimeout, skew, redis, config)
+	if err != nil {
+		return nil, err
+	}
+
+	sharded, err := pUtils.NewShardedLocation(ctx, location, redis, os.Getenv("REDIS_PROXIMITY_CHANNEL_IN"), shard, count, serviceId)
+	if err != nil {
+		return nil, err
+	}
+
+	return sharded, nil
+}
+
 func main() {
 	logger := log.New(os.Stdout, "[Gateway] ", log.Ldate|log.Ltime)
 	ctx := context.Background()
@@ -44,8 +159,76 @@ func main() {
 	brokerIn := utils.NewBrokerRedis(ctx, redis, os.Getenv("REDIS_PROXIMITY_CHANNEL_IN"), serviceId)
 	brokerOut := utils.NewBrokerRedis(ctx, redis, os.Getenv("REDIS_GATEWAY_CHANNEL_IN"), serviceId)
 
-	location := pUtils.NewLocation(ctx, serviceId, locationTimeout, redis, lock)
+	// Security events are only logged without a security channel
+	var brokerSecurity utils.Broker
+	if channel := os.Getenv("REDIS_SECURITY_CHANNEL"); channel != "" {
+		brokerSecurity = utils.NewBrokerRedis(ctx, redis, channel, serviceId)
+	}
+
+	indexConfig, err := spatialIndexConfig()
+	if err != nil {
+		logger.Fatalln(err)
+	}
+
+	skew, err := maxClockSkew()
+	if err != nil {
+		logger.Fatalln(err)
+	}
+
+	movement, err := movementPolicy(ctx, redis)
+	if err != nil {
+		logger.Fatalln(err)
+	}
+
+	location, err := locationStore(ctx, redis, skew, indexConfig)
+	if err != nil {
+		logger.Fatalln(err)
+	}
+
+	geofences := pUtils.NewGeofences(ctx, redis)
+	if err := geofences.Load(); err != nil {
+		logger.Fatalln(err)
+	}
+
+	subscriptions := pUtils.NewSubscriptions(ctx, redis, locationTimeout)
+	history, err := locationHistory(ctx, redis)
+	if err != nil {
+		logger.Fatalln(err)
+	}
+
+	// Warm start from the shared state before listening for messages
+	if err := location.Restore(); err != nil {
+		logger.Println("failed to restore location: ", err)
+	}
+
+	// Each group syncs through its own keys and warm starts when first used
+	groups := pUtils.NewGroups(ctx, redis, location, func(group string) (pUtils.LocationStore, error) {
+		return pUtils.NewLocationStore(ctx, os.Getenv("PROXIMITY_LOCATION_STORE"), helpers.FormatKey(serviceId, "group", group), locationTimeout, skew, redis, indexConfig)
+	})
+
+	// Publish the final local changes on graceful shutdown
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+
+		logger.Println("stopping proximity service...")
+
+		if err := groups.Sync(); err != nil {
+			logger.Println("failed to sync location: ", err)
+		}
+
+		if err := groups.Snapshot(); err != nil {
+			logger.Println("failed to snapshot location: ", err)
+		}
+
+		redis.Close()
+		os.Exit(0)
+	}()
+
+	privacy := pUtils.NewPrivacy(ctx, redis)
+	visibility := pUtils.NewVisibility(ctx, redis)
 
 	logger.Println("starting proximity service...")
-	controller.Controller(ctx, location, brokerIn, brokerOut, lock, logger)
+	controller.Controller(ctx, groups, geofences, subscriptions, history, privacy, visibility, movement, brokerIn, brokerOut, brokerSecurity, lock, logger)
 }
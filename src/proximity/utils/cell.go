@@ -0,0 +1,116 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+)
+
+// Integer coordinates of a partition where x grows east and y grows north
+type Cell struct {
+	X     uint32
+	Y     uint32
+	Depth uint
+}
+
+// Spread the bits of a value so they occupy the even bits
+func spreadBits(value uint32) uint64 {
+	v := uint64(value)
+
+	v = (v | (v << 16)) & 0x0000ffff0000ffff
+	v = (v | (v << 8)) & 0x00ff00ff00ff00ff
+	v = (v | (v << 4)) & 0x0f0f0f0f0f0f0f0f
+	v = (v | (v << 2)) & 0x3333333333333333
+	v = (v | (v << 1)) & 0x5555555555555555
+
+	return v
+}
+
+// Compact the even bits of a value
+func compactBits(value uint64) uint32 {
+	v := value & 0x5555555555555555
+
+	v = (v | (v >> 1)) & 0x3333333333333333
+	v = (v | (v >> 2)) & 0x0f0f0f0f0f0f0f0f
+	v = (v | (v >> 4)) & 0x00ff00ff00ff00ff
+	v = (v | (v >> 8)) & 0x0000ffff0000ffff
+	v = (v | (v >> 16)) & 0x00000000ffffffff
+
+	return uint32(v)
+}
+
+// Interleave the coordinates as a Morton code with y in the odd bits
+func MortonEncode(x uint32, y uint32) uint64 {
+	return spreadBits(x) | spreadBits(y)<<1
+}
+
+// Split a Morton code into its coordinates
+func MortonDecode(code uint64) (uint32, uint32) {
+	return compactBits(code), compactBits(code >> 1)
+}
+
+// Create a new cell from a partition
+func NewCellFromPartition(p *Partition) (*Cell, error) {
+	var code uint64
+
+	for _, char := range p.Encoded {
+		if char < '0' || char > '3' {
+			return nil, errors.New("invalid string character")
+		}
+
+		code = code<<2 | uint64(char-'0')
+	}
+
+	x, y := MortonDecode(code)
+
+	return &Cell{X: x, Y: y, Depth: uint(len(p.Encoded))}, nil
+}
+
+// Encode the cell as the string of its partition
+func (c *Cell) Encoded() string {
+	code := MortonEncode(c.X, c.Y)
+	buffer := strings.Builder{}
+	buffer.Grow(int(c.Depth))
+
+	for i := int(c.Depth) - 1; i >= 0; i-- {
+		buffer.WriteByte(byte('0' + (code>>(2*uint(i)))&3))
+	}
+
+	return buffer.String()
+}
+
+// Find all cells within a rectangle of rows and columns around the cell where columns wrap across the antimeridian and rows stop at the poles
+func (c *Cell) Nearby(rows int, cols int) []*Cell {
+	size := int64(1) << c.Depth
+
+	// Tall rectangles stop at the poles
+	if int64(rows) > size {
+		rows = int(size)
+	}
+
+	// Wide rectangles cover every column once
+	if int64(2*cols+1) >= size {
+		cols = int(size / 2)
+	}
+
+	out := make([]*Cell, 0)
+
+	for dy := -rows; dy <= rows; dy++ {
+		y := int64(c.Y) + int64(dy)
+		if y < 0 || y >= size {
+			continue
+		}
+
+		for dx := -cols; dx <= cols; dx++ {
+			// Even sized grids would otherwise visit the opposite column twice
+			if dx == cols && int64(2*cols) == size {
+				continue
+			}
+
+			x := ((int64(c.X)+int64(dx))%size + size) % size
+
+			out = append(out, &Cell{X: uint32(x), Y: uint32(y), Depth: c.Depth})
+		}
+	}
+
+	return out
+}
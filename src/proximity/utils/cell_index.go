@@ -0,0 +1,239 @@
+package utils
+
+import (
+	"errors"
+	"math"
+	"sync"
+)
+
+type indexEntry struct {
+	lat  float64
+	long float64
+	cell string
+}
+
+// Shared bookkeeping for indexes which bucket users into grid cells guarded by a single lock
+type cellIndex struct {
+	mutex    sync.RWMutex
+	cells    map[string]map[string]bool
+	users    map[string]*indexEntry
+	encode   func(float64, float64) (string, error)
+	latSize  float64
+	longSize float64
+}
+
+// Create a new cell index with a cell encoder and the cell size in degrees
+func newCellIndex(encode func(float64, float64) (string, error), latSize float64, longSize float64) *cellIndex {
+	return &cellIndex{cells: make(map[string]map[string]bool), users: make(map[string]*indexEntry), encode: encode, latSize: latSize, longSize: longSize}
+}
+
+// Add a user to their cell
+func (c *cellIndex) add(user string, entry *indexEntry) {
+	c.users[user] = entry
+
+	cellUsers, ok := c.cells[entry.cell]
+	if !ok {
+		cellUsers = make(map[string]bool)
+		c.cells[entry.cell] = cellUsers
+	}
+
+	cellUsers[user] = true
+}
+
+// Remove a user from their cell
+func (c *cellIndex) remove(user string) {
+	entry, ok := c.users[user]
+	if !ok {
+		return
+	}
+
+	delete(c.users, user)
+
+	cellUsers := c.cells[entry.cell]
+	delete(cellUsers, user)
+
+	if len(cellUsers) == 0 {
+		delete(c.cells, entry.cell)
+	}
+}
+
+// Insert a new user
+func (c *cellIndex) Insert(user string, lat float64, long float64) error {
+	cell, err := c.encode(lat, long)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.users[user]; ok {
+		return errors.New("user already exists")
+	}
+
+	c.add(user, &indexEntry{lat: lat, long: long, cell: cell})
+
+	return nil
+}
+
+// Move an existing user
+func (c *cellIndex) Move(user string, lat float64, long float64) error {
+	cell, err := c.encode(lat, long)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.users[user]; !ok {
+		return errors.New("user does not exist")
+	}
+
+	c.remove(user)
+	c.add(user, &indexEntry{lat: lat, long: long, cell: cell})
+
+	return nil
+}
+
+// Remove a user
+func (c *cellIndex) Remove(user string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.remove(user)
+}
+
+// Find the users in the given cells which match the filter
+func (c *cellIndex) query(cells []string, filter func(*indexEntry) bool) []string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	users := make([]string, 0)
+	for _, cell := range cells {
+		for user := range c.cells[cell] {
+			if filter(c.users[user]) {
+				users = append(users, user)
+			}
+		}
+	}
+
+	return users
+}
+
+// Find all users matching the filter regardless of their cell
+func (c *cellIndex) queryAll(filter func(*indexEntry) bool) []string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	users := make([]string, 0)
+	for user, entry := range c.users {
+		if filter(entry) {
+			users = append(users, user)
+		}
+	}
+
+	return users
+}
+
+// Estimate the number of cells which overlap a bounding box
+func (c *cellIndex) boxCount(minLat float64, minLong float64, maxLat float64, maxLong float64) float64 {
+	spanLong := maxLong - minLong
+	if spanLong < 0 {
+		spanLong += LongMax - LongMin
+	}
+
+	return (math.Ceil((maxLat-minLat)/c.latSize) + 1) * (math.Ceil(spanLong/c.longSize) + 1)
+}
+
+// Check if it is cheaper to scan every occupied cell than the cells of a bounding box
+func (c *cellIndex) sparse(minLat float64, minLong float64, maxLat float64, maxLong float64) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.boxCount(minLat, minLong, maxLat, maxLong) > float64(len(c.cells))
+}
+
+// Find all cells which overlap a bounding box splitting boxes which cross the antimeridian
+func (c *cellIndex) boxCells(minLat float64, minLong float64, maxLat float64, maxLong float64) ([]string, error) {
+	if minLat > maxLat {
+		return nil, errors.New("invalid bounding box")
+	}
+
+	if minLong > maxLong {
+		east, err := c.boxCells(minLat, minLong, maxLat, LongMax)
+		if err != nil {
+			return nil, err
+		}
+
+		west, err := c.boxCells(minLat, LongMin, maxLat, maxLong)
+		if err != nil {
+			return nil, err
+		}
+
+		return append(east, west...), nil
+	}
+
+	// Sampling every cell size guarantees no cell is skipped
+	latSteps := int(math.Ceil((maxLat - minLat) / c.latSize))
+	longSteps := int(math.Ceil((maxLong - minLong) / c.longSize))
+
+	seen := make(map[string]bool)
+	cells := make([]string, 0)
+
+	for i := 0; i <= latSteps; i++ {
+		lat := math.Min(minLat+float64(i)*c.latSize, maxLat)
+
+		for j := 0; j <= longSteps; j++ {
+			long := math.Min(minLong+float64(j)*c.longSize, maxLong)
+
+			cell, err := c.encode(lat, long)
+			if err != nil {
+				return nil, err
+			}
+
+			if _, ok := seen[cell]; ok {
+				continue
+			}
+			seen[cell] = true
+
+			cells = append(cells, cell)
+		}
+	}
+
+	return cells, nil
+}
+
+// Find all users within a bounding box which match the filter scanning every occupied cell when that is cheaper
+func (c *cellIndex) queryBox(minLat float64, minLong float64, maxLat float64, maxLong float64, filter func(*indexEntry) bool) ([]string, error) {
+	if minLat > maxLat {
+		return nil, errors.New("invalid bounding box")
+	}
+
+	if c.sparse(minLat, minLong, maxLat, maxLong) {
+		return c.queryAll(filter), nil
+	}
+
+	cells, err := c.boxCells(minLat, minLong, maxLat, maxLong)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.query(cells, filter), nil
+}
+
+// Find all users within a bounding box where the minimum longitude exceeds the maximum when crossing the antimeridian
+func (c *cellIndex) QueryBox(minLat float64, minLong float64, maxLat float64, maxLong float64) ([]string, error) {
+	return c.queryBox(minLat, minLong, maxLat, maxLong, func(entry *indexEntry) bool {
+		return InBox(entry.lat, entry.long, minLat, minLong, maxLat, maxLong)
+	})
+}
+
+// Find all users within a radius in meters using the bounding box of the circle
+func (c *cellIndex) QueryRadius(lat float64, long float64, radius float64) ([]string, error) {
+	minLat, minLong, maxLat, maxLong := BoundingBox(lat, long, radius)
+
+	return c.queryBox(minLat, minLong, maxLat, maxLong, func(entry *indexEntry) bool {
+		return Haversine(lat, long, entry.lat, entry.long) <= radius
+	})
+}
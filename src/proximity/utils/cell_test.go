@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"strconv"
+	"testing"
+)
+
+// Find the partitions within a square by a breadth first search over translations as the previous implementation did
+func nearbyBFS(p *Partition, radius int) []*Partition {
+	seen := map[string]bool{p.Encoded: true}
+	out := []*Partition{p}
+	frontier := []*Partition{p}
+
+	for step := 0; step < radius; step++ {
+		next := make([]*Partition, 0)
+
+		for _, partition := range frontier {
+			for _, dir := range []Direction{DirUp, DirDown, DirLeft, DirRight} {
+				neighbor, err := partition.Translate(dir)
+				if err != nil || seen[neighbor.Encoded] {
+					continue
+				}
+
+				seen[neighbor.Encoded] = true
+				out = append(out, neighbor)
+				next = append(next, neighbor)
+			}
+		}
+
+		frontier = next
+	}
+
+	return out
+}
+
+// Find the partitions within a square of cells around a partition
+func nearbyCells(t testing.TB, p *Partition, radius int) []string {
+	cell, err := NewCellFromPartition(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cells := cell.Nearby(radius, radius)
+	out := make([]string, len(cells))
+
+	for i, cell := range cells {
+		out[i] = cell.Encoded()
+	}
+
+	return out
+}
+
+func TestCellNearbySquare(t *testing.T) {
+	partition, err := NewPartitionFromCoords(37.7749, -122.4194, DefaultPartitionDepth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for radius := 0; radius <= 5; radius++ {
+		partitions := nearbyCells(t, partition, radius)
+
+		side := 2*radius + 1
+		if len(partitions) != side*side {
+			t.Fatalf("radius %d: got %d partitions, want %d", radius, len(partitions), side*side)
+		}
+
+		seen := make(map[string]bool)
+		for _, encoded := range partitions {
+			if seen[encoded] {
+				t.Fatalf("radius %d: duplicate partition %s", radius, encoded)
+			}
+
+			seen[encoded] = true
+		}
+
+		// The square contains the diamond the search used to visit
+		for _, p := range nearbyBFS(partition, radius) {
+			if !seen[p.Encoded] {
+				t.Fatalf("radius %d: missing partition %s", radius, p.Encoded)
+			}
+		}
+	}
+}
+
+func BenchmarkCellNearby(b *testing.B) {
+	partition, err := NewPartitionFromCoords(37.7749, -122.4194, DefaultPartitionDepth)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, radius := range []int{1, 5, 10} {
+		b.Run("cell/"+strconv.Itoa(radius), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				nearbyCells(b, partition, radius)
+			}
+		})
+
+		b.Run("bfs/"+strconv.Itoa(radius), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				nearbyBFS(partition, radius)
+			}
+		})
+	}
+}
+
+func BenchmarkMortonEncode(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		x, y := MortonDecode(MortonEncode(uint32(i), uint32(i>>1)))
+		if x != uint32(i) || y != uint32(i>>1) {
+			b.Fatal("round trip failed")
+		}
+	}
+}
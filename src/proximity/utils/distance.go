@@ -0,0 +1,110 @@
+package utils
+
+import "math"
+
+// Mean radius of the earth in meters
+const EarthRadius = 6371000
+
+// Convert degrees to radians
+func toRadians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
+
+// Calculate the great-circle distance in meters between two coordinates
+func Haversine(lat1 float64, long1 float64, lat2 float64, long2 float64) float64 {
+	phi1 := toRadians(lat1)
+	phi2 := toRadians(lat2)
+	deltaPhi := toRadians(lat2 - lat1)
+	deltaLambda := toRadians(long2 - long1)
+
+	a := math.Sin(deltaPhi/2)*math.Sin(deltaPhi/2) + math.Cos(phi1)*math.Cos(phi2)*math.Sin(deltaLambda/2)*math.Sin(deltaLambda/2)
+
+	return 2 * EarthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// Calculate the bounding box of a circle with a radius in meters where the minimum longitude exceeds the maximum when crossing the antimeridian
+func BoundingBox(lat float64, long float64, radius float64) (float64, float64, float64, float64) {
+	deltaLat := radius / (toRadians(1) * EarthRadius)
+
+	minLat := math.Max(lat-deltaLat, LatMin)
+	maxLat := math.Min(lat+deltaLat, LatMax)
+
+	// Near the poles the circle covers every longitude
+	cos := math.Min(math.Cos(toRadians(minLat)), math.Cos(toRadians(maxLat)))
+	if cos <= 0 || deltaLat/cos >= (LongMax-LongMin)/2 {
+		return minLat, LongMin, maxLat, LongMax
+	}
+
+	deltaLong := deltaLat / cos
+
+	minLong := long - deltaLong
+	if minLong < LongMin {
+		minLong += LongMax - LongMin
+	}
+
+	maxLong := long + deltaLong
+	if maxLong > LongMax {
+		maxLong -= LongMax - LongMin
+	}
+
+	return minLat, minLong, maxLat, maxLong
+}
+
+// Widen a bounding box by a padding in meters on every side where the minimum longitude exceeds the maximum when crossing the antimeridian
+func PadBox(minLat float64, minLong float64, maxLat float64, maxLong float64, padding float64) (float64, float64, float64, float64) {
+	deltaLat := padding / (toRadians(1) * EarthRadius)
+
+	minLat = math.Max(minLat-deltaLat, LatMin)
+	maxLat = math.Min(maxLat+deltaLat, LatMax)
+
+	span := maxLong - minLong
+	if span < 0 {
+		span += LongMax - LongMin
+	}
+
+	// Near the poles the padded box covers every longitude
+	cos := math.Min(math.Cos(toRadians(minLat)), math.Cos(toRadians(maxLat)))
+	if cos <= 0 || span+2*deltaLat/cos >= LongMax-LongMin {
+		return minLat, LongMin, maxLat, LongMax
+	}
+
+	deltaLong := deltaLat / cos
+
+	minLong -= deltaLong
+	if minLong < LongMin {
+		minLong += LongMax - LongMin
+	}
+
+	maxLong += deltaLong
+	if maxLong > LongMax {
+		maxLong -= LongMax - LongMin
+	}
+
+	return minLat, minLong, maxLat, maxLong
+}
+
+// Check if a coordinate lies within a bounding box which may cross the antimeridian
+func InBox(lat float64, long float64, minLat float64, minLong float64, maxLat float64, maxLong float64) bool {
+	if lat < minLat || lat > maxLat {
+		return false
+	}
+
+	if minLong > maxLong {
+		return long >= minLong || long <= maxLong
+	}
+
+	return long >= minLong && long <= maxLong
+}
+
+// Calculate the center of a bounding box which may cross the antimeridian
+func BoxCenter(minLat float64, minLong float64, maxLat float64, maxLong float64) (float64, float64) {
+	centerLong := (minLong + maxLong) / 2
+	if minLong > maxLong {
+		centerLong += (LongMax - LongMin) / 2
+		if centerLong > LongMax {
+			centerLong -= LongMax - LongMin
+		}
+	}
+
+	return (minLat + maxLat) / 2, centerLong
+}
@@ -0,0 +1,507 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/bengosborn/cue/helpers"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+type Geofence struct {
+	Id       string   `json:"id"`
+	Name     string   `json:"name"`
+	Owner    string   `json:"owner"`
+	Receiver string   `json:"receiver"`
+	Group    string   `json:"group,omitempty"`
+	Lat      float64  `json:"lat"`
+	Long     float64  `json:"long"`
+	Radius   float64  `json:"radius,omitempty"`
+	Points   []*Point `json:"points,omitempty"`
+}
+
+type GeofenceEvent struct {
+	Geofence  string    `json:"geofence"`
+	Name      string    `json:"name"`
+	User      string    `json:"user"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type GeofenceTransition struct {
+	Geofence *Geofence
+	Entered  bool
+}
+
+type Geofences struct {
+	ctx     context.Context
+	redis   *redis.Client
+	mutex   sync.RWMutex
+	fences  map[string]*Geofence
+	owners  map[string]map[string]*Geofence
+	indexes map[string]SpatialIndex
+	reach   map[string]float64
+	version int64
+}
+
+const (
+	geofenceRegistryKey = "geofence:registry"
+	geofenceVersionKey  = "geofence:version"
+	geofenceOwnerPrefix = "geofence:owner"
+	geofenceUserPrefix  = "geofence:user"
+	MaxGeofenceName     = 64
+	MaxGeofenceRadius   = 50000
+	MaxGeofencesPerUser = 100
+
+	// Distance in meters a user must move outside a geofence before exiting so boundary jitter does not repeat events
+	GeofenceHysteresis = 25
+
+	// Depth of the index over geofence centers where a cell is wider than the largest geofence
+	geofenceIndexDepth = 8
+)
+
+// Store a new geofence unless the owner has too many and return the new registry version
+var createGeofenceScript = redis.NewScript(`
+if redis.call("SCARD", KEYS[2]) >= tonumber(ARGV[3]) then
+	return -1
+end
+
+redis.call("SADD", KEYS[2], ARGV[1])
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+
+return redis.call("INCR", KEYS[3])
+`)
+
+// Replace a stored geofence unless it was deleted and return the new registry version
+var updateGeofenceScript = redis.NewScript(`
+if redis.call("HEXISTS", KEYS[1], ARGV[1]) == 0 then
+	return -1
+end
+
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+
+return redis.call("INCR", KEYS[2])
+`)
+
+// Delete a geofence and return the new registry version
+var deleteGeofenceScript = redis.NewScript(`
+redis.call("SREM", KEYS[2], ARGV[1])
+redis.call("HDEL", KEYS[1], ARGV[1])
+
+return redis.call("INCR", KEYS[3])
+`)
+
+// Parse and validate a new geofence from a message body
+func NewGeofence(body string, owner string, receiver string) (*Geofence, error) {
+	fence := &Geofence{}
+	if err := json.Unmarshal([]byte(body), fence); err != nil {
+		return nil, errors.New("invalid geofence")
+	}
+
+	if fence.Name == "" || len(fence.Name) > MaxGeofenceName {
+		return nil, errors.New("invalid geofence name")
+	}
+
+	// Only members of the group trigger the geofence
+	if !validGroup(fence.Group) {
+		return nil, errors.New("invalid group")
+	}
+
+	// A geofence is either a circle or a polygon
+	if fence.Points == nil {
+		if !inBounds(fence.Lat, fence.Long) || fence.Radius <= 0 || fence.Radius > MaxGeofenceRadius {
+			return nil, errors.New("invalid geofence circle")
+		}
+	} else {
+		if fence.Radius != 0 || len(fence.Points) < 3 || len(fence.Points) > MaxPolygonPoints {
+			return nil, errors.New("invalid geofence polygon")
+		}
+
+		for _, point := range fence.Points {
+			if point == nil || !inBounds(point.Lat, point.Long) {
+				return nil, errors.New("invalid geofence polygon")
+			}
+		}
+
+		fence.Lat, fence.Long = 0, 0
+
+		// Polygons are indexed by their center so they may reach no further than the largest circle
+		if fence.reach() > MaxGeofenceRadius {
+			return nil, errors.New("geofence polygon too large")
+		}
+	}
+
+	fence.Id = uuid.NewString()
+	fence.Owner = owner
+	fence.Receiver = receiver
+
+	return fence, nil
+}
+
+// Center of a circle or of the bounds of a polygon
+func (g *Geofence) center() (float64, float64) {
+	if g.Points == nil {
+		return g.Lat, g.Long
+	}
+
+	minLat, minLong, maxLat, maxLong := PolygonBounds(g.Points)
+
+	return (minLat + maxLat) / 2, (minLong + maxLong) / 2
+}
+
+// Furthest distance in meters from the center to the boundary
+func (g *Geofence) reach() float64 {
+	if g.Points == nil {
+		return g.Radius
+	}
+
+	lat, long := g.center()
+
+	reach := 0.0
+	for _, point := range g.Points {
+		reach = math.Max(reach, Haversine(lat, long, point.Lat, point.Long))
+	}
+
+	return reach
+}
+
+// Check if a coordinate is inside the geofence
+func (g *Geofence) Contains(lat float64, long float64) bool {
+	if g.Points != nil {
+		return InPolygon(lat, long, g.Points)
+	}
+
+	return Haversine(g.Lat, g.Long, lat, long) <= g.Radius
+}
+
+// Distance in meters from a coordinate outside the geofence to its boundary
+func (g *Geofence) Distance(lat float64, long float64) float64 {
+	if g.Contains(lat, long) {
+		return 0
+	}
+
+	if g.Points != nil {
+		return DistanceToPolygon(lat, long, g.Points)
+	}
+
+	return Haversine(g.Lat, g.Long, lat, long) - g.Radius
+}
+
+// Make a new geofence registry
+func NewGeofences(ctx context.Context, redis *redis.Client) *Geofences {
+	geofences := &Geofences{ctx: ctx, redis: redis}
+	geofences.reset(make(map[string]*Geofence), 0)
+
+	return geofences
+}
+
+// Replace the geofences and their indexes where the caller holds the lock
+func (g *Geofences) reset(fences map[string]*Geofence, version int64) {
+	g.fences = make(map[string]*Geofence)
+	g.owners = make(map[string]map[string]*Geofence)
+	g.indexes = make(map[string]SpatialIndex)
+	g.reach = make(map[string]float64)
+	g.version = version
+
+	for _, fence := range fences {
+		g.add(fence)
+	}
+}
+
+// Add or replace a geofence in the indexes where the caller holds the lock
+func (g *Geofences) add(fence *Geofence) {
+	g.remove(fence.Id)
+
+	// Each group has its own index so users are only checked against the geofences of their group
+	index, ok := g.indexes[fence.Group]
+	if !ok {
+		// The depth is always in bounds
+		index, _ = NewQuadtreeIndex(geofenceIndexDepth, 1)
+		g.indexes[fence.Group] = index
+	}
+
+	lat, long := fence.center()
+	if err := index.Insert(fence.Id, lat, long); err != nil {
+		return
+	}
+
+	g.fences[fence.Id] = fence
+	g.reach[fence.Group] = math.Max(g.reach[fence.Group], fence.reach())
+
+	if g.owners[fence.Owner] == nil {
+		g.owners[fence.Owner] = make(map[string]*Geofence)
+	}
+	g.owners[fence.Owner][fence.Id] = fence
+}
+
+// Remove a geofence from the indexes where the caller holds the lock
+func (g *Geofences) remove(id string) {
+	fence, ok := g.fences[id]
+	if !ok {
+		return
+	}
+
+	g.indexes[fence.Group].Remove(id)
+	delete(g.fences, id)
+
+	delete(g.owners[fence.Owner], id)
+	if len(g.owners[fence.Owner]) == 0 {
+		delete(g.owners, fence.Owner)
+	}
+}
+
+// Record the registry version after a local change and keep it stale if another instance changed the registry in between
+func (g *Geofences) advance(version int64) {
+	if version == g.version+1 {
+		g.version = version
+	}
+}
+
+// Reload the registry from redis
+func (g *Geofences) Load() error {
+	var versionCmd *redis.StringCmd
+	var rawCmd *redis.MapStringStringCmd
+
+	// Read the version with the registry so a change between them is never missed
+	if _, err := g.redis.TxPipelined(g.ctx, func(pipe redis.Pipeliner) error {
+		versionCmd = pipe.Get(g.ctx, geofenceVersionKey)
+		rawCmd = pipe.HGetAll(g.ctx, geofenceRegistryKey)
+
+		return nil
+	}); err != nil && err != redis.Nil {
+		return err
+	}
+
+	version, err := versionCmd.Int64()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	fences := make(map[string]*Geofence)
+	for id, data := range rawCmd.Val() {
+		fence := &Geofence{}
+		if err := json.Unmarshal([]byte(data), fence); err != nil {
+			return err
+		}
+
+		fences[id] = fence
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.reset(fences, version)
+
+	return nil
+}
+
+// Reload the registry if another instance changed it since the version
+func (g *Geofences) sync(version int64) error {
+	g.mutex.RLock()
+	current := g.version
+	g.mutex.RUnlock()
+
+	if version == current {
+		return nil
+	}
+
+	return g.Load()
+}
+
+// Store a new geofence unless the owner already has the most allowed
+func (g *Geofences) Create(fence *Geofence) error {
+	data, err := json.Marshal(fence)
+	if err != nil {
+		return err
+	}
+
+	keys := []string{geofenceRegistryKey, helpers.FormatKey(geofenceOwnerPrefix, fence.Owner), geofenceVersionKey}
+
+	version, err := createGeofenceScript.Run(g.ctx, g.redis, keys, fence.Id, data, MaxGeofencesPerUser).Int64()
+	if err != nil {
+		return err
+	}
+
+	if version == -1 {
+		return errors.New("too many geofences")
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.add(fence)
+	g.advance(version)
+
+	return nil
+}
+
+// Delete a geofence belonging to an owner
+func (g *Geofences) Delete(owner string, id string) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	fence, ok := g.fences[id]
+	if !ok || fence.Owner != owner {
+		return errors.New("geofence does not exist")
+	}
+
+	keys := []string{geofenceRegistryKey, helpers.FormatKey(geofenceOwnerPrefix, owner), geofenceVersionKey}
+
+	version, err := deleteGeofenceScript.Run(g.ctx, g.redis, keys, id).Int64()
+	if err != nil {
+		return err
+	}
+
+	g.remove(id)
+	g.advance(version)
+
+	return nil
+}
+
+// Update the receiver of the geofences belonging to an owner if it has changed
+func (g *Geofences) Refresh(owner string, receiver string) error {
+	g.mutex.RLock()
+	stale := make([]*Geofence, 0)
+	for _, fence := range g.owners[owner] {
+		if fence.Receiver != receiver {
+			// Transitions may still hold the old geofence so it is copied rather than changed
+			refreshed := *fence
+			refreshed.Receiver = receiver
+			stale = append(stale, &refreshed)
+		}
+	}
+	g.mutex.RUnlock()
+
+	for _, fence := range stale {
+		data, err := json.Marshal(fence)
+		if err != nil {
+			return err
+		}
+
+		version, err := updateGeofenceScript.Run(g.ctx, g.redis, []string{geofenceRegistryKey, geofenceVersionKey}, fence.Id, data).Int64()
+		if err != nil {
+			return err
+		}
+
+		// Deleted by another instance
+		if version == -1 {
+			continue
+		}
+
+		g.mutex.Lock()
+		if _, ok := g.fences[fence.Id]; ok {
+			g.add(fence)
+		}
+		g.advance(version)
+		g.mutex.Unlock()
+	}
+
+	return nil
+}
+
+// List the geofences belonging to an owner
+func (g *Geofences) List(owner string) []*Geofence {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+
+	fences := make([]*Geofence, 0, len(g.owners[owner]))
+	for _, fence := range g.owners[owner] {
+		fences = append(fences, fence)
+	}
+
+	return fences
+}
+
+// Update the geofences of a group a user is inside and return the transitions
+func (g *Geofences) Update(group string, userData *UserData) ([]*GeofenceTransition, error) {
+	userKey := helpers.FormatKey(geofenceUserPrefix, userData.User)
+
+	// Membership is shared so each transition is only reported once across instances
+	pipe := g.redis.Pipeline()
+	membersCmd := pipe.SMembers(g.ctx, userKey)
+	versionCmd := pipe.Get(g.ctx, geofenceVersionKey)
+	if _, err := pipe.Exec(g.ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	// Geofences changed on other instances apply before the next transition
+	version, err := versionCmd.Int64()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	if err := g.sync(version); err != nil {
+		return nil, err
+	}
+
+	inside := make(map[string]bool)
+	for _, id := range membersCmd.Val() {
+		inside[id] = true
+	}
+
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+
+	// Only geofences centered close enough to contain the user can be entered while any the user is inside can be exited
+	candidates := make([]string, 0)
+	if index, ok := g.indexes[group]; ok {
+		candidates, err = index.QueryRadius(userData.Lat, userData.Long, g.reach[group])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for id := range inside {
+		candidates = append(candidates, id)
+	}
+
+	transitions := make([]*GeofenceTransition, 0)
+	checked := make(map[string]bool)
+
+	for _, id := range candidates {
+		fence, ok := g.fences[id]
+		if !ok || fence.Group != group || checked[id] {
+			continue
+		}
+		checked[id] = true
+
+		if fence.Contains(userData.Lat, userData.Long) {
+			if inside[id] {
+				continue
+			}
+
+			added, err := g.redis.SAdd(g.ctx, userKey, id).Result()
+			if err != nil {
+				return nil, err
+			}
+
+			if added == 1 {
+				transitions = append(transitions, &GeofenceTransition{Geofence: fence, Entered: true})
+			}
+		} else if inside[id] && fence.Distance(userData.Lat, userData.Long) > GeofenceHysteresis {
+			removed, err := g.redis.SRem(g.ctx, userKey, id).Result()
+			if err != nil {
+				return nil, err
+			}
+
+			if removed == 1 {
+				transitions = append(transitions, &GeofenceTransition{Geofence: fence, Entered: false})
+			}
+		}
+	}
+
+	// Forget deleted geofences
+	for id := range inside {
+		if _, ok := g.fences[id]; !ok {
+			if err := g.redis.SRem(g.ctx, userKey, id).Err(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return transitions, nil
+}
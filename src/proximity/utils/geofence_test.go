@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"context"
+	"sort"
+	"testing"
+)
+
+func TestNewGeofencePolygonReach(t *testing.T) {
+	if _, err := NewGeofence(`{"name": "park", "points": [{"lat": 37.7, "long": -122.5}, {"lat": 37.8, "long": -122.5}, {"lat": 37.8, "long": -122.4}]}`, "a", "r"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewGeofence(`{"name": "state", "points": [{"lat": 32, "long": -124}, {"lat": 42, "long": -124}, {"lat": 42, "long": -114}]}`, "a", "r"); err == nil {
+		t.Fatal("got no error for a polygon reaching further than the largest circle")
+	}
+}
+
+func TestGeofencesIndex(t *testing.T) {
+	geofences := NewGeofences(context.Background(), nil)
+
+	bodies := []string{
+		`{"name": "home", "lat": 37.7749, "long": -122.4194, "radius": 500}`,
+		`{"name": "work", "lat": 37.79, "long": -122.40, "radius": 50000}`,
+		`{"name": "park", "points": [{"lat": 37.76, "long": -122.49}, {"lat": 37.77, "long": -122.49}, {"lat": 37.77, "long": -122.45}]}`,
+		`{"name": "away", "lat": 51.5, "long": -0.12, "radius": 1000}`,
+	}
+
+	fences := make(map[string]*Geofence)
+	for _, body := range bodies {
+		fence, err := NewGeofence(body, "a", "r")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fences[fence.Name] = fence
+		geofences.add(fence)
+	}
+
+	// Every geofence containing a point is a candidate
+	for _, point := range []*Point{{Lat: 37.7749, Long: -122.4194}, {Lat: 37.765, Long: -122.46}, {Lat: 38.2, Long: -122.4}, {Lat: 51.5, Long: -0.12}} {
+		candidates, err := geofences.indexes[""].QueryRadius(point.Lat, point.Long, geofences.reach[""])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		found := make(map[string]bool)
+		for _, id := range candidates {
+			found[id] = true
+		}
+
+		for name, fence := range fences {
+			if fence.Contains(point.Lat, point.Long) && !found[fence.Id] {
+				t.Fatalf("geofence %s contains %v but is not a candidate", name, point)
+			}
+		}
+
+		if len(candidates) == len(fences) {
+			t.Fatalf("got every geofence as a candidate for %v", point)
+		}
+	}
+
+	// Geofences of a group are indexed apart from the default group
+	group, err := NewGeofence(`{"name": "trail", "group": "hikers", "lat": 37.7749, "long": -122.4194, "radius": 500}`, "a", "r")
+	if err != nil {
+		t.Fatal(err)
+	}
+	geofences.add(group)
+
+	candidates, err := geofences.indexes[""].QueryRadius(37.7749, -122.4194, geofences.reach[""])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range candidates {
+		if id == group.Id {
+			t.Fatal("got a geofence of another group as a candidate")
+		}
+	}
+
+	if candidates, err := geofences.indexes["hikers"].QueryRadius(37.7749, -122.4194, geofences.reach["hikers"]); err != nil || len(candidates) != 1 || candidates[0] != group.Id {
+		t.Fatalf("got candidates %v for the group", candidates)
+	}
+
+	if _, err := NewGeofence(`{"name": "trail", "group": "hikers:all", "lat": 37.7749, "long": -122.4194, "radius": 500}`, "a", "r"); err == nil {
+		t.Fatal("got no error for an invalid group")
+	}
+
+	geofences.remove(group.Id)
+	geofences.remove(fences["home"].Id)
+
+	names := make([]string, 0)
+	for _, fence := range geofences.List("a") {
+		names = append(names, fence.Name)
+	}
+	sort.Strings(names)
+
+	if len(names) != 3 || names[0] != "away" || names[1] != "park" || names[2] != "work" {
+		t.Fatalf("got geofences %v after removing home", names)
+	}
+
+	if len(geofences.List("b")) != 0 {
+		t.Fatal("got geofences for another owner")
+	}
+}
@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+)
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// Encode a latitude and longitude as a geohash of the given precision
+func EncodeGeohash(lat float64, long float64, precision int) (string, error) {
+	if lat < LatMin || lat > LatMax || long < LongMin || long > LongMax {
+		return "", errors.New("out of bounds")
+	}
+
+	buffer := strings.Builder{}
+
+	latMin, latMax := float64(LatMin), float64(LatMax)
+	longMin, longMax := float64(LongMin), float64(LongMax)
+
+	// Bits alternate between longitude and latitude starting with longitude
+	even := true
+	bit := 0
+	index := 0
+
+	for buffer.Len() < precision {
+		if even {
+			mid := (longMin + longMax) / 2
+
+			if long >= mid {
+				index = index*2 + 1
+				longMin = mid
+			} else {
+				index = index * 2
+				longMax = mid
+			}
+		} else {
+			mid := (latMin + latMax) / 2
+
+			if lat >= mid {
+				index = index*2 + 1
+				latMin = mid
+			} else {
+				index = index * 2
+				latMax = mid
+			}
+		}
+
+		even = !even
+		bit += 1
+
+		if bit == 5 {
+			buffer.WriteByte(geohashAlphabet[index])
+
+			bit = 0
+			index = 0
+		}
+	}
+
+	return buffer.String(), nil
+}
+
+// Size of a geohash cell in degrees for the given precision
+func GeohashSize(precision int) (float64, float64) {
+	bits := 5 * precision
+	longBits := (bits + 1) / 2
+	latBits := bits / 2
+
+	return (LatMax - LatMin) / float64(uint(1)<<latBits), (LongMax - LongMin) / float64(uint(1)<<longBits)
+}
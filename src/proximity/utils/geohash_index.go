@@ -0,0 +1,18 @@
+package utils
+
+// Precision of geohash cells which are roughly 5 km x 5 km
+const GeohashPrecision = 5
+
+// Spatial index over geohash cells
+type GeohashIndex struct {
+	*cellIndex
+}
+
+// Create a new geohash index
+func NewGeohashIndex() *GeohashIndex {
+	latSize, longSize := GeohashSize(GeohashPrecision)
+
+	return &GeohashIndex{cellIndex: newCellIndex(func(lat float64, long float64) (string, error) {
+		return EncodeGeohash(lat, long, GeohashPrecision)
+	}, latSize, longSize)}
+}
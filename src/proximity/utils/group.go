@@ -0,0 +1,356 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/bengosborn/cue/helpers"
+	"github.com/redis/go-redis/v9"
+)
+
+// Isolated namespaces of users where each group has its own location store and users only see members of the same group
+type Groups struct {
+	ctx       context.Context
+	redis     *redis.Client
+	mutex     sync.RWMutex
+	location  LocationStore
+	locations map[string]LocationStore
+	create    func(group string) (LocationStore, error)
+	listeners []func(string, LocationStore) func(*UserData)
+}
+
+type GroupScope struct {
+	Groups []string `json:"groups"`
+}
+
+type GroupBatch struct {
+	GroupScope
+	Fixes []*UserData `json:"fixes"`
+}
+
+// Bounds for group names, the groups of a single message and the groups created by a single user
+const (
+	MaxGroups         = 1000
+	MaxGroupsPerScope = 10
+	MaxGroupsPerUser  = 5
+	MaxGroupLength    = 64
+)
+
+// Groups shared by every instance with the user who created each of them
+const groupRegistryKey = "group:registry"
+
+// Register a group for its creator unless it exists and report 1 when it can be used, 0 when it does not exist, -1 when there are too many groups and -2 when the creator made too many groups
+var registerGroupScript = redis.NewScript(`
+	if redis.call("HEXISTS", KEYS[1], ARGV[1]) == 1 then
+		return 1
+	end
+
+	if ARGV[2] == "" then
+		return 0
+	end
+
+	if redis.call("HLEN", KEYS[1]) >= tonumber(ARGV[3]) then
+		return -1
+	end
+
+	if redis.call("SCARD", KEYS[2]) >= tonumber(ARGV[4]) then
+		return -2
+	end
+
+	redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+	redis.call("SADD", KEYS[2], ARGV[1])
+
+	return 1
+`)
+
+// Make a new set of groups where the default group uses the location store and other groups are created by the first member to send a location
+func NewGroups(ctx context.Context, redis *redis.Client, location LocationStore, create func(group string) (LocationStore, error)) *Groups {
+	return &Groups{
+		ctx:       ctx,
+		redis:     redis,
+		location:  location,
+		locations: make(map[string]LocationStore),
+		create:    create,
+		listeners: make([]func(string, LocationStore) func(*UserData), 0),
+	}
+}
+
+// Scope a key to a group where the default group keeps the unscoped key
+func GroupKey(key string, group string) string {
+	if group == "" {
+		return key
+	}
+
+	return helpers.FormatKey(key, group)
+}
+
+// Check if a group name can be used inside keys
+func validGroup(group string) bool {
+	if len(group) > MaxGroupLength {
+		return false
+	}
+
+	for _, c := range group {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Validate the groups of a message where no groups means the default group
+func (s *GroupScope) validate() error {
+	if len(s.Groups) > MaxGroupsPerScope {
+		return errors.New("too many groups")
+	}
+
+	seen := make(map[string]bool)
+	for _, group := range s.Groups {
+		if group == "" || !validGroup(group) || seen[group] {
+			return errors.New("invalid group")
+		}
+
+		seen[group] = true
+	}
+
+	return nil
+}
+
+// Parse the groups targeted by a message from its body
+func NewGroupScope(body string) (*GroupScope, error) {
+	scope := &GroupScope{}
+
+	if body != "" {
+		if err := json.Unmarshal([]byte(body), scope); err != nil {
+			return nil, errors.New("invalid groups")
+		}
+	}
+
+	if err := scope.validate(); err != nil {
+		return nil, err
+	}
+
+	return scope, nil
+}
+
+// Parse a batch of fixes which is either a list of fixes for the default group or an object with the groups and fixes
+func NewGroupBatch(body string) (*GroupBatch, error) {
+	batch := &GroupBatch{Fixes: make([]*UserData, 0)}
+	if err := json.Unmarshal([]byte(body), &batch.Fixes); err == nil {
+		return batch, nil
+	}
+
+	if err := json.Unmarshal([]byte(body), batch); err != nil {
+		return nil, errors.New("invalid batch")
+	}
+
+	if err := batch.validate(); err != nil {
+		return nil, err
+	}
+
+	return batch, nil
+}
+
+// Get the location store of the default group
+func (g *Groups) Default() LocationStore {
+	return g.location
+}
+
+// Get the location store of an existing group where the empty group is the default group
+func (g *Groups) Get(group string) (LocationStore, error) {
+	return g.open(group, "")
+}
+
+// Open the location store of a group where only a user may create a missing group
+func (g *Groups) open(group string, user string) (LocationStore, error) {
+	if group == "" {
+		return g.location, nil
+	}
+
+	if !validGroup(group) {
+		return nil, errors.New("invalid group")
+	}
+
+	g.mutex.RLock()
+	location, ok := g.locations[group]
+	g.mutex.RUnlock()
+
+	if ok {
+		return location, nil
+	}
+
+	if err := g.register(group, user); err != nil {
+		return nil, err
+	}
+
+	// Other instances may already share the group so it is restored before anyone can see it
+	location, err := g.create(group)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := location.Restore(); err != nil {
+		return nil, err
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	// Another message may have opened the group meanwhile
+	if existing, ok := g.locations[group]; ok {
+		return existing, nil
+	}
+
+	for _, listener := range g.listeners {
+		location.OnUpsert(listener(group, location))
+	}
+
+	g.locations[group] = location
+
+	return location, nil
+}
+
+// Check a group exists or register it for the user who creates it
+func (g *Groups) register(group string, user string) error {
+	keys := []string{groupRegistryKey, helpers.FormatKey("group:creator", user)}
+
+	result, err := registerGroupScript.Run(g.ctx, g.redis, keys, group, user, MaxGroups, MaxGroupsPerUser).Int()
+	if err != nil {
+		return err
+	}
+
+	switch result {
+	case 0:
+		return errors.New("group does not exist")
+	case -1:
+		return errors.New("too many groups")
+	case -2:
+		return errors.New("too many groups created")
+	}
+
+	return nil
+}
+
+// Get the location stores of the existing groups targeted by a message
+func (g *Groups) Scope(scope *GroupScope) ([]LocationStore, error) {
+	return g.scope(scope, "")
+}
+
+// Get the location stores of the groups targeted by a message and create the missing ones for the user
+func (g *Groups) JoinScope(scope *GroupScope, user string) ([]LocationStore, error) {
+	if user == "" {
+		return nil, errors.New("invalid user")
+	}
+
+	return g.scope(scope, user)
+}
+
+// Open the location stores of the groups targeted by a message
+func (g *Groups) scope(scope *GroupScope, user string) ([]LocationStore, error) {
+	if len(scope.Groups) == 0 {
+		return []LocationStore{g.location}, nil
+	}
+
+	out := make([]LocationStore, len(scope.Groups))
+	for i, group := range scope.Groups {
+		location, err := g.open(group, user)
+		if err != nil {
+			return nil, err
+		}
+
+		out[i] = location
+	}
+
+	return out, nil
+}
+
+// Get the location stores of every group in use starting with the default group
+func (g *Groups) All() []LocationStore {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+
+	out := make([]LocationStore, 0, len(g.locations)+1)
+	out = append(out, g.location)
+
+	for _, location := range g.locations {
+		out = append(out, location)
+	}
+
+	return out
+}
+
+// Add a listener made for the name and store of each group which is notified of upserts inside the group
+func (g *Groups) OnUpsert(fn func(string, LocationStore) func(*UserData)) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.listeners = append(g.listeners, fn)
+
+	g.location.OnUpsert(fn("", g.location))
+	for group, location := range g.locations {
+		location.OnUpsert(fn(group, location))
+	}
+}
+
+// Sync every group
+func (g *Groups) Sync() error {
+	errs := make([]error, 0)
+	for _, location := range g.All() {
+		if err := location.Sync(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Snapshot every group
+func (g *Groups) Snapshot() error {
+	errs := make([]error, 0)
+	for _, location := range g.All() {
+		if err := location.Snapshot(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Evict expired users from every group
+func (g *Groups) Evict() (*EvictionStats, error) {
+	total := &EvictionStats{}
+	errs := make([]error, 0)
+
+	for _, location := range g.All() {
+		stats, err := location.Evict()
+		if err != nil {
+			errs = append(errs, err)
+
+			continue
+		}
+
+		total.Users += stats.Users
+		total.Tombstones += stats.Tombstones
+		total.Events += stats.Events
+	}
+
+	return total, errors.Join(errs...)
+}
+
+// Totals evicted from every group
+func (g *Groups) Evicted() EvictionStats {
+	total := EvictionStats{}
+
+	for _, location := range g.All() {
+		stats := location.Evicted()
+
+		total.Users += stats.Users
+		total.Tombstones += stats.Tombstones
+		total.Events += stats.Events
+	}
+
+	return total
+}
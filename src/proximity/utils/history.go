@@ -0,0 +1,121 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/bengosborn/cue/helpers"
+	"github.com/redis/go-redis/v9"
+)
+
+type History struct {
+	ctx       context.Context
+	redis     *redis.Client
+	retention time.Duration
+	limit     int64
+}
+
+type TrailQuery struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+type TrailResponse struct {
+	Version int         `json:"version"`
+	Fixes   []*UserData `json:"fixes"`
+}
+
+const (
+	historyPrefix        = "location:history"
+	TrailResponseVersion = 1
+	DefaultHistoryLimit  = 1000
+)
+
+// Make a new location history store keeping at most the limit of fixes per user for the retention period
+func NewHistory(ctx context.Context, redis *redis.Client, retention time.Duration, limit int64) (*History, error) {
+	if retention <= 0 {
+		return nil, errors.New("history retention must be positive")
+	}
+
+	if limit <= 0 {
+		return nil, errors.New("history limit must be positive")
+	}
+
+	return &History{ctx: ctx, redis: redis, retention: retention, limit: limit}, nil
+}
+
+// Record fixes for a user ordered by their timestamp and trim the fixes outside the retention limits
+func (h *History) Record(user string, fixes []*UserData) error {
+	if len(fixes) == 0 {
+		return nil
+	}
+
+	members := make([]redis.Z, len(fixes))
+	for i, fix := range fixes {
+		data, err := json.Marshal(fix)
+		if err != nil {
+			return err
+		}
+
+		members[i] = redis.Z{Score: float64(fix.Timestamp.UnixMilli()), Member: data}
+	}
+
+	key := helpers.FormatKey(historyPrefix, user)
+	cutoff := time.Now().Add(-h.retention).UnixMilli()
+
+	_, err := h.redis.TxPipelined(h.ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZAdd(h.ctx, key, members...)
+		pipe.ZRemRangeByScore(h.ctx, key, "-inf", strconv.FormatInt(cutoff, 10))
+		pipe.ZRemRangeByRank(h.ctx, key, 0, -h.limit-1)
+		pipe.Expire(h.ctx, key, h.retention)
+
+		return nil
+	})
+
+	return err
+}
+
+// Parse and validate a trail query from a message body
+func NewTrailQuery(body string) (*TrailQuery, error) {
+	query := &TrailQuery{}
+	if err := json.Unmarshal([]byte(body), query); err != nil {
+		return nil, errors.New("invalid trail query")
+	}
+
+	if query.To.IsZero() {
+		query.To = time.Now()
+	}
+
+	if query.From.After(query.To) {
+		return nil, errors.New("invalid trail range")
+	}
+
+	return query, nil
+}
+
+// Retrieve the fixes of a user between two timestamps in chronological order
+func (h *History) Trail(user string, from time.Time, to time.Time) ([]*UserData, error) {
+	raw, err := h.redis.ZRangeByScore(h.ctx, helpers.FormatKey(historyPrefix, user), &redis.ZRangeBy{
+		Min:   strconv.FormatInt(from.UnixMilli(), 10),
+		Max:   strconv.FormatInt(to.UnixMilli(), 10),
+		Count: h.limit,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	fixes := make([]*UserData, len(raw))
+	for i, data := range raw {
+		fix := &UserData{}
+		if err := json.Unmarshal([]byte(data), fix); err != nil {
+			return nil, err
+		}
+
+		fixes[i] = fix
+	}
+
+	return fixes, nil
+}
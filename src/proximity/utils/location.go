@@ -5,149 +5,476 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/bengosborn/cue/helpers"
-	"github.com/bengosborn/cue/utils"
+	"github.com/google/uuid"
 	"github.com/redis/go-redis/v9"
 )
 
-type UserData struct {
-	User      string    `json:"user"`
-	Lat       float32   `json:"lat"`
-	Long      float32   `json:"long"`
-	Timestamp time.Time `json:"timestamp"`
+type BatchRejection struct {
+	Index  int    `json:"index"`
+	Reason string `json:"reason"`
+}
+
+type BatchResult struct {
+	Applied  int               `json:"applied"`
+	Accepted []int             `json:"accepted"`
+	Rejected []*BatchRejection `json:"rejected"`
+}
+
+type EvictionStats struct {
+	Users      int `json:"users"`
+	Tombstones int `json:"tombstones"`
+	Events     int `json:"events"`
+}
+
+type NearbyUser struct {
+	Data      *UserData  `json:"data"`
+	Partition *Partition `json:"partition"`
+	Distance  float64    `json:"distance"`
 }
 
 type Location struct {
 	id         string
 	ctx        context.Context
 	redis      *redis.Client
-	lock       *utils.ResourceLockDistributed
+	node       string
+	offset     string
 	mutex      sync.RWMutex
-	Location   *sync.Map
+	syncMutex  sync.Mutex
+	index      SpatialIndex
+	config     *SpatialIndexConfig
 	User       *sync.Map
+	Tombstone  *sync.Map
 	EventStack *list.List
 	ttl        time.Duration
+	skew       time.Duration
+	listeners  []func(*UserData)
+	evicted    EvictionStats
 }
 
 const (
-	statePrefix = "location:stage"
+	streamPrefix   = "location:stream"
+	snapshotPrefix = "location:snapshot"
+	syncBatchSize  = 500
+	MaxBatchSize   = 100
 )
 
-// Make a new location structure
-func NewLocation(ctx context.Context, id string, ttl time.Duration, redis *redis.Client, lock *utils.ResourceLockDistributed) *Location {
-	return &Location{ctx: ctx, Location: &sync.Map{}, User: &sync.Map{}, redis: redis, lock: lock, EventStack: list.New(), id: id, ttl: ttl}
+// Returned when an upsert is older than the stored location of the user
+var ErrStaleLocation = errors.New("location is older than the stored location")
+
+// Make a new location structure backed by a spatial index which accepts timestamps up to the skew in the future and syncs through a shared stream
+func NewLocation(ctx context.Context, id string, ttl time.Duration, skew time.Duration, redis *redis.Client, config *SpatialIndexConfig) (*Location, error) {
+	index, err := NewSpatialIndex(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Location{ctx: ctx, User: &sync.Map{}, Tombstone: &sync.Map{}, redis: redis, EventStack: list.New(), id: id, node: uuid.NewString(), offset: "0", ttl: ttl, skew: skew, index: index, config: config}, nil
 }
 
 // Add a new user
-func (l *Location) upsert(user string, lat float32, long float32, timestamp time.Time) error {
-	// Get the partition
-	partition, err := NewPartitionFromCoords(lat, long)
-	if err != nil {
-		return err
+func (l *Location) upsert(user string, fix *UserData) error {
+	// Removed users only return with a newer update
+	if value, ok := l.Tombstone.Load(user); ok {
+		if !fix.Timestamp.After(value.(time.Time)) {
+			return ErrStaleLocation
+		}
+
+		l.Tombstone.Delete(user)
 	}
 
-	// Remove the user from the previous partition if they already exist
+	// Move the user if they already exist unless the update is older
 	value, ok := l.User.Load(user)
 	if ok {
-		prev := value.(*Partition)
+		if value.(*UserData).Timestamp.After(fix.Timestamp) {
+			return ErrStaleLocation
+		}
 
-		value, ok := l.Location.Load(prev.Encoded)
-		if ok {
-			partitionUsers := value.(map[string]*UserData)
+		if err := l.index.Move(user, fix.Lat, fix.Long); err != nil {
+			return err
+		}
+	} else if err := l.index.Insert(user, fix.Lat, fix.Long); err != nil {
+		return err
+	}
 
-			if userData, ok := partitionUsers[user]; !ok || userData.Timestamp.After(timestamp) {
-				return nil
-			}
+	l.User.Store(user, fix.copyFor(user))
 
-			delete(partitionUsers, user)
+	return nil
+}
+
+// Insert an event keeping the event stack ordered from newest to oldest
+func (l *Location) pushEvent(event *UserData) {
+	for e := l.EventStack.Front(); e != nil; e = e.Next() {
+		if !e.Value.(*UserData).Timestamp.After(event.Timestamp) {
+			l.EventStack.InsertBefore(event, e)
+
+			return
 		}
 	}
 
-	// Add the user to the partition
-	l.User.Store(user, partition)
-	value, _ = l.Location.LoadOrStore(partition.Encoded, make(map[string]*UserData))
-	partitionUsers := value.(map[string]*UserData)
+	l.EventStack.PushBack(event)
+}
 
-	partitionUsers[user] = &UserData{User: user, Lat: lat, Long: long, Timestamp: timestamp}
+// Validate a client reported fix which may be up to the skew in the future
+func validateFix(fix *UserData, now time.Time, skew time.Duration) error {
+	if err := fix.Validate(); err != nil {
+		return err
+	}
+
+	if fix.Timestamp.After(now.Add(skew)) {
+		return errors.New("timestamp is in the future")
+	}
 
 	return nil
 }
 
-// Public method for upsert which locks
-func (l *Location) Upsert(user string, lat float32, long float32) error {
+// Validate every fix in a batch and return the index of the newest accepted fix or -1 if none were accepted
+func validateBatch(user string, fixes []*UserData, validate func(fix *UserData) error) (*BatchResult, int, error) {
+	if len(fixes) == 0 || len(fixes) > MaxBatchSize {
+		return nil, -1, errors.New("batch size out of bounds")
+	}
+
+	result := &BatchResult{Applied: -1, Accepted: make([]int, 0), Rejected: make([]*BatchRejection, 0)}
+
+	newest := -1
+	for i, fix := range fixes {
+		if fix == nil {
+			result.Rejected = append(result.Rejected, &BatchRejection{Index: i, Reason: "missing fix"})
+			continue
+		}
+
+		if fix.Timestamp.IsZero() {
+			result.Rejected = append(result.Rejected, &BatchRejection{Index: i, Reason: "missing timestamp"})
+			continue
+		}
+
+		if err := validate(fix); err != nil {
+			result.Rejected = append(result.Rejected, &BatchRejection{Index: i, Reason: err.Error()})
+			continue
+		}
+
+		fix.User = user
+		fix.Removed = false
+		result.Accepted = append(result.Accepted, i)
+
+		if newest == -1 || fix.Timestamp.After(fixes[newest].Timestamp) {
+			newest = i
+		}
+	}
+
+	return result, newest, nil
+}
+
+// Every accepted fix which was not applied is kept for the history
+func unappliedFixes(result *BatchResult, fixes []*UserData) []*UserData {
+	recorded := make([]*UserData, 0)
+	for _, i := range result.Accepted {
+		if i != result.Applied {
+			recorded = append(recorded, fixes[i])
+		}
+	}
+
+	return recorded
+}
+
+// Validate a client reported fix
+func (l *Location) validate(fix *UserData, now time.Time) error {
+	return validateFix(fix, now, l.skew)
+}
+
+// Notify listeners of an applied upsert
+func (l *Location) notify(userData *UserData, listeners []func(*UserData)) {
+	for _, fn := range listeners {
+		fn(userData)
+	}
+}
+
+// Public method for upsert at the time reported by the client which locks and notifies listeners once unlocked
+func (l *Location) Upsert(user string, fix *UserData) error {
+	userData := fix.copyFor(user)
+
+	// Clients without a clock are stamped on arrival
+	now := time.Now()
+
+	if userData.Timestamp.IsZero() {
+		userData.Timestamp = now
+	}
+
+	if err := l.validate(userData, now); err != nil {
+		return err
+	}
+
 	l.mutex.Lock()
-	defer l.mutex.Unlock()
 
-	timestamp := time.Now()
+	if err := l.upsert(user, userData); err != nil {
+		l.mutex.Unlock()
 
-	if err := l.upsert(user, lat, long, timestamp); err != nil {
 		return err
 	}
 
-	l.EventStack.PushFront(&UserData{User: user, Timestamp: timestamp, Lat: lat, Long: long})
+	l.pushEvent(userData.copyFor(user))
+
+	listeners := l.listeners
+
+	l.mutex.Unlock()
+
+	l.notify(userData, listeners)
+
+	return nil
+}
+
+// Upsert a batch of fixes for a user in one locked operation applying only the newest and returning the accepted fixes which were not applied
+func (l *Location) UpsertBatch(user string, fixes []*UserData) (*BatchResult, []*UserData, error) {
+	now := time.Now()
+
+	result, newest, err := validateBatch(user, fixes, func(fix *UserData) error {
+		return l.validate(fix, now)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if newest == -1 {
+		return result, make([]*UserData, 0), nil
+	}
+
+	l.mutex.Lock()
+
+	applied := fixes[newest]
+	if err := l.upsert(user, applied); err == nil {
+		result.Applied = newest
+		l.pushEvent(applied.copyFor(user))
+	} else if err != ErrStaleLocation {
+		l.mutex.Unlock()
+
+		return nil, nil, err
+	}
+
+	listeners := l.listeners
+
+	l.mutex.Unlock()
+
+	recorded := unappliedFixes(result, fixes)
+
+	if result.Applied != -1 {
+		l.notify(applied.copyFor(user), listeners)
+	}
+
+	return result, recorded, nil
+}
+
+// Remove a user and leave a tombstone unless the user was updated after the removal
+func (l *Location) remove(user string, timestamp time.Time) {
+	if value, ok := l.User.Load(user); ok {
+		if value.(*UserData).Timestamp.After(timestamp) {
+			return
+		}
+
+		l.index.Remove(user)
+		l.User.Delete(user)
+	}
+
+	l.Tombstone.Store(user, timestamp)
+}
+
+// Remove a user at a given time which locks and records the removal for other instances
+func (l *Location) removeAt(user string, timestamp time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.remove(user, timestamp)
+	l.pushEvent(&UserData{User: user, Timestamp: timestamp, Removed: true})
+}
+
+// Public method for remove which locks and records the removal for other instances
+func (l *Location) Remove(user string) error {
+	l.removeAt(user, time.Now())
 
 	return nil
 }
 
-// Get nearby users
-func (l *Location) Nearby(user string, radius int) ([]string, error) {
+// Remove expired users, tombstones and events and return how many were evicted
+func (l *Location) Evict() (*EvictionStats, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	cutoff := time.Now().Add(-l.ttl)
+	stats := &EvictionStats{}
+
+	l.User.Range(func(key, value interface{}) bool {
+		if value.(*UserData).Timestamp.Before(cutoff) {
+			user := key.(string)
+
+			l.index.Remove(user)
+			l.User.Delete(user)
+
+			stats.Users += 1
+		}
+
+		return true
+	})
+
+	l.Tombstone.Range(func(key, value interface{}) bool {
+		if value.(time.Time).Before(cutoff) {
+			l.Tombstone.Delete(key)
+
+			stats.Tombstones += 1
+		}
+
+		return true
+	})
+
+	// Events are ordered from newest to oldest
+	for e := l.EventStack.Back(); e != nil && e.Value.(*UserData).Timestamp.Before(cutoff); e = l.EventStack.Back() {
+		l.EventStack.Remove(e)
+
+		stats.Events += 1
+	}
+
+	l.evicted.Users += stats.Users
+	l.evicted.Tombstones += stats.Tombstones
+	l.evicted.Events += stats.Events
+
+	return stats, nil
+}
+
+// Total number of entries evicted since the location was created
+func (l *Location) Evicted() EvictionStats {
 	l.mutex.RLock()
 	defer l.mutex.RUnlock()
 
-	// Get the partition for the user
-	value, ok := l.User.Load(user)
-	if !ok {
-		return nil, errors.New("user does not exist")
-	}
-	userPartition := value.(*Partition)
+	return l.evicted
+}
 
-	// Get the nearby partitions and find all users
-	partitions, err := userPartition.Nearby(radius)
-	if err != nil {
-		return nil, err
+// Register a function to be called after every local upsert
+func (l *Location) OnUpsert(fn func(*UserData)) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.listeners = append(l.listeners, fn)
+}
+
+// Collect the fresh candidates matching the filter sorted by distance from a reference point excluding the user
+func (l *Location) collect(user string, candidates []string, lat float64, long float64, freshness time.Duration, filter func(*UserData) bool) ([]*NearbyUser, error) {
+	// Users older than the ttl are always stale
+	if freshness <= 0 || freshness > l.ttl {
+		freshness = l.ttl
 	}
 
-	users := make([]string, 0)
-	for _, partition := range *partitions {
-		value, ok := l.Location.Load(partition.Encoded)
-		if !ok {
+	users := make([]*NearbyUser, 0)
+	for _, usr := range candidates {
+		value, ok := l.User.Load(usr)
+		if usr == user || !ok {
 			continue
 		}
-		partitionUsers := value.(map[string]*UserData)
+		usrData := value.(*UserData)
 
-		for usr, usrData := range partitionUsers {
-			if usr != user && time.Now().Before(usrData.Timestamp.Add(l.ttl)) {
-				users = append(users, usr)
-			}
+		if !time.Now().Before(usrData.Timestamp.Add(freshness)) || !filter(usrData) {
+			continue
 		}
+
+		partition, err := NewPartitionFromCoords(usrData.Lat, usrData.Long, l.depth())
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, &NearbyUser{Data: usrData, Partition: partition, Distance: Haversine(lat, long, usrData.Lat, usrData.Long)})
 	}
 
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Distance < users[j].Distance
+	})
+
 	return users, nil
 }
 
-// Get the data for a given user
-func (l *Location) get(user string) (*UserData, error) {
-	value, ok := l.User.Load(user)
-	if !ok {
-		return nil, errors.New("user does not exist")
+// Get nearby users within a radius in meters seen within the freshness window sorted by distance
+func (l *Location) Nearby(user string, radius float64, freshness time.Duration) ([]*NearbyUser, error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	userData, err := l.get(user)
+	if err != nil {
+		return nil, err
 	}
-	partition := value.(*Partition)
 
-	value, ok = l.Location.Load(partition.Encoded)
-	if !ok {
-		return nil, errors.New("user does not exist")
+	return l.around(user, userData.Lat, userData.Long, radius, freshness)
+}
+
+// Get users within a radius in meters of a point excluding the user
+func (l *Location) around(user string, lat float64, long float64, radius float64, freshness time.Duration) ([]*NearbyUser, error) {
+	// Find all users within the radius
+	candidates, err := l.index.QueryRadius(lat, long, radius)
+	if err != nil {
+		return nil, err
+	}
+
+	return l.collect(user, candidates, lat, long, freshness, func(*UserData) bool { return true })
+}
+
+// Get users within a radius in meters of a point seen within the freshness window sorted by distance excluding the user
+func (l *Location) Around(user string, lat float64, long float64, radius float64, freshness time.Duration) ([]*NearbyUser, error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	return l.around(user, lat, long, radius, freshness)
+}
+
+// Get users within a bounding box seen within the freshness window sorted by distance from the center of the box
+func (l *Location) Box(user string, minLat float64, minLong float64, maxLat float64, maxLong float64, freshness time.Duration) ([]*NearbyUser, error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	candidates, err := l.index.QueryBox(minLat, minLong, maxLat, maxLong)
+	if err != nil {
+		return nil, err
 	}
-	users := value.(map[string]*UserData)
 
-	userData, ok := users[user]
+	centerLat, centerLong := BoxCenter(minLat, minLong, maxLat, maxLong)
+
+	return l.collect(user, candidates, centerLat, centerLong, freshness, func(*UserData) bool { return true })
+}
+
+// Get users within a polygon seen within the freshness window sorted by distance from the center of its bounds
+func (l *Location) Polygon(user string, points []*Point, freshness time.Duration) ([]*NearbyUser, error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	// Find candidates within the bounds of the polygon then filter exactly
+	minLat, minLong, maxLat, maxLong := PolygonBounds(points)
+
+	candidates, err := l.index.QueryBox(minLat, minLong, maxLat, maxLong)
+	if err != nil {
+		return nil, err
+	}
+
+	return l.collect(user, candidates, (minLat+maxLat)/2, (minLong+maxLong)/2, freshness, func(userData *UserData) bool {
+		return InPolygon(userData.Lat, userData.Long, points)
+	})
+}
+
+// Depth of the partitions reported for users
+func (l *Location) depth() uint {
+	if l.config.Depth == 0 {
+		return DefaultPartitionDepth
+	}
+
+	return l.config.Depth
+}
+
+// Get the data for a given user
+func (l *Location) get(user string) (*UserData, error) {
+	value, ok := l.User.Load(user)
 	if !ok {
-		panic("user exists but not in partition")
+		return nil, errors.New("user does not exist")
 	}
 
-	return userData, nil
+	return value.(*UserData), nil
 }
 
 // Public method to get the user with locks
@@ -158,151 +485,187 @@ func (l *Location) Get(user string) (*UserData, error) {
 	return l.get(user)
 }
 
-// Merge changes between two lists
-func (l *Location) merge(merge *Location) {
-	seen := make(map[string]bool)
-	temp := list.New()
-
-	// Sync local changes with shared state
-	for l.EventStack.Len() > 0 || merge.EventStack.Len() > 0 {
-		// Choose the most recent event
-		var event *UserData
-		var value *list.Element
-		var location *Location
-
-		value1 := l.EventStack.Front()
-		value2 := merge.EventStack.Front()
-
-		if value1 == nil {
-			event = value2.Value.(*UserData)
-			value = value2
-			location = merge
-		} else if value2 == nil {
-			event = value1.Value.(*UserData)
-			value = value1
-			location = l
-		} else {
-			event1 := value1.Value.(*UserData)
-			event2 := value2.Value.(*UserData)
-
-			if event1.Timestamp.After(event2.Timestamp) {
-				event = event1
-				value = value1
-				location = l
-			} else {
-				event = event2
-				value = value2
-				location = merge
-			}
-		}
+// Publish the local events since the last sync to the stream from oldest to newest
+func (l *Location) publish() error {
+	streamKey := helpers.FormatKey(streamPrefix, l.id)
 
-		// Ensure no duplicate processing
-		location.EventStack.Remove(value)
+	l.mutex.Lock()
 
-		if _, ok := seen[event.User]; ok {
-			continue
-		}
+	events := make([]*UserData, 0, l.EventStack.Len())
+	for e := l.EventStack.Back(); e != nil; e = e.Prev() {
+		events = append(events, e.Value.(*UserData))
+	}
+	l.EventStack.Init()
+
+	l.mutex.Unlock()
 
-		seen[event.User] = true
+	if len(events) == 0 {
+		return nil
+	}
+
+	// Entries older than the ttl are trimmed as they can no longer be applied
+	minId := strconv.FormatInt(time.Now().Add(-l.ttl).UnixMilli(), 10)
 
-		// Add event to both locations
-		if time.Now().Before(event.Timestamp.Add(l.ttl)) {
-			l.upsert(event.User, event.Lat, event.Long, event.Timestamp)
-			merge.upsert(event.User, event.Lat, event.Long, event.Timestamp)
+	_, err := l.redis.Pipelined(l.ctx, func(pipe redis.Pipeliner) error {
+		for _, event := range events {
+			data, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
 
-			temp.PushFront(event)
+			pipe.XAdd(l.ctx, &redis.XAddArgs{Stream: streamKey, MinID: minId, Approx: true, Values: map[string]interface{}{"node": l.node, "event": string(data)}})
 		}
-	}
 
-	// Push temp stack elements back
-	for temp.Len() > 0 {
-		value := temp.Front()
-		event := value.Value.(*UserData)
-		temp.Remove(value)
+		return nil
+	})
+	if err != nil {
+		// Requeue the events for the next sync as applying an event twice has no effect
+		l.mutex.Lock()
+		for _, event := range events {
+			l.pushEvent(event)
+		}
+		l.mutex.Unlock()
 
-		l.EventStack.PushFront(event)
-		merge.EventStack.PushFront(&UserData{User: event.User, Timestamp: event.Timestamp, Lat: event.Lat, Long: event.Long})
+		return err
 	}
+
+	return nil
 }
 
-// Public method for merge which locks
-func (l *Location) Merge(merge *Location) {
-	l.mutex.Lock()
-	defer l.mutex.Unlock()
+// Apply the events published by other instances since the last read offset
+func (l *Location) apply() error {
+	streamKey := helpers.FormatKey(streamPrefix, l.id)
 
-	merge.mutex.Lock()
-	defer merge.mutex.Unlock()
+	for {
+		streams, err := l.redis.XRead(l.ctx, &redis.XReadArgs{Streams: []string{streamKey, l.offset}, Count: syncBatchSize, Block: -1}).Result()
+		if err == redis.Nil {
+			return nil
+		} else if err != nil {
+			return err
+		}
 
-	l.merge(merge)
-}
+		messages := streams[0].Messages
+		cutoff := time.Now().Add(-l.ttl)
 
-// Sync local changes
-func (l *Location) Sync() error {
-	stateKey := helpers.FormatKey(statePrefix, l.id)
+		l.mutex.Lock()
 
-	l.lock.Lock(l.id)
-	defer l.lock.Unlock(l.id, true)
+		for _, message := range messages {
+			l.offset = message.ID
 
-	l.mutex.Lock()
-	defer l.mutex.Unlock()
+			if node, ok := message.Values["node"].(string); !ok || node == l.node {
+				continue
+			}
 
-	data, err := l.redis.Get(l.ctx, stateKey).Result()
-	if err == nil {
-		staged := &Location{}
-		if err := json.Unmarshal([]byte(data), staged); err != nil {
-			return err
+			data, ok := message.Values["event"].(string)
+			if !ok {
+				continue
+			}
+
+			event := &UserData{}
+			if err := json.Unmarshal([]byte(data), event); err != nil || event.Timestamp.Before(cutoff) {
+				continue
+			}
+
+			// Stale events are ignored by upsert and remove
+			if event.Removed {
+				l.remove(event.User, event.Timestamp)
+			} else {
+				l.upsert(event.User, event)
+			}
 		}
 
-		l.merge(staged)
-	} else if err != redis.Nil {
+		l.mutex.Unlock()
+
+		if len(messages) < syncBatchSize {
+			return nil
+		}
+	}
+}
+
+// Sync local changes by publishing new events and applying the events of other instances
+func (l *Location) Sync() error {
+	l.syncMutex.Lock()
+	defer l.syncMutex.Unlock()
+
+	if err := l.publish(); err != nil {
 		return err
 	}
 
-	// Push changes locally to redis
-	locationData, err := json.Marshal(l)
+	return l.apply()
+}
+
+// Store the state of the location along with its stream offset as the latest shared snapshot
+func (l *Location) Snapshot() error {
+	l.syncMutex.Lock()
+	defer l.syncMutex.Unlock()
+
+	data, err := json.Marshal(l)
 	if err != nil {
 		return err
 	}
-	l.redis.Set(l.ctx, stateKey, locationData, 0)
 
-	return nil
+	// Snapshots older than the ttl only contain expired users
+	return l.redis.Set(l.ctx, helpers.FormatKey(snapshotPrefix, l.id), data, l.ttl).Err()
+}
+
+// Replace the state with the latest shared snapshot and apply the events published since it was taken which must happen before any upserts
+func (l *Location) Restore() error {
+	data, err := l.redis.Get(l.ctx, helpers.FormatKey(snapshotPrefix, l.id)).Result()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	if err == nil {
+		l.syncMutex.Lock()
+		err := json.Unmarshal([]byte(data), l)
+		l.syncMutex.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return l.Sync()
 }
 
 type temp struct {
-	Location   *map[string]map[string]*UserData `json:"location"`
-	User       *map[string]*Partition           `json:"user"`
-	EventStack *[]*UserData                     `json:"eventStack"`
+	User       map[string]*UserData `json:"users"`
+	Tombstone  map[string]time.Time `json:"tombstones"`
+	EventStack []*UserData          `json:"eventStack"`
+	Offset     string               `json:"offset"`
 }
 
+// Serialize the state of the location which locks
 func (l *Location) MarshalJSON() ([]byte, error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
 	return json.Marshal(&temp{
-		Location: func() *map[string]map[string]*UserData {
-			m := make(map[string]map[string]*UserData)
+		User: func() map[string]*UserData {
+			m := make(map[string]*UserData)
+
+			l.User.Range(func(key, value interface{}) bool {
+				user := key.(string)
 
-			l.Location.Range(func(key, value interface{}) bool {
-				location := key.(string)
+				m[user] = value.(*UserData)
 
-				m[location] = value.(map[string]*UserData)
 				return true
 			})
 
-			return &m
+			return m
 		}(),
-		User: func() *map[string]*Partition {
-			m := make(map[string]*Partition)
+		Tombstone: func() map[string]time.Time {
+			m := make(map[string]time.Time)
 
-			l.User.Range(func(key, value interface{}) bool {
-				user := key.(string)
-				partition := value.(*Partition)
-
-				m[user] = partition
+			l.Tombstone.Range(func(key, value interface{}) bool {
+				m[key.(string)] = value.(time.Time)
 
 				return true
 			})
 
-			return &m
+			return m
 		}(),
-		EventStack: func() *[]*UserData {
+		EventStack: func() []*UserData {
 			result := make([]*UserData, l.EventStack.Len())
 			i := 0
 
@@ -311,37 +674,60 @@ func (l *Location) MarshalJSON() ([]byte, error) {
 				i += 1
 			}
 
-			return &result
+			return result
 		}(),
+		Offset: l.offset,
 	})
 }
 
+// Replace the state of the location which locks
 func (l *Location) UnmarshalJSON(data []byte) error {
 	tmp := &temp{}
 	if err := json.Unmarshal(data, tmp); err != nil {
 		return err
 	}
 
-	// Update the event stack
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// Update the event stack and the tombstones it carries
 	eventStack := list.New()
-	for _, value := range *tmp.EventStack {
+	tombstoneSyncMap := &sync.Map{}
+	for key, value := range tmp.Tombstone {
+		tombstoneSyncMap.Store(key, value)
+	}
+
+	for _, value := range tmp.EventStack {
 		eventStack.PushBack(value)
+
+		if value.Removed {
+			tombstoneSyncMap.LoadOrStore(value.User, value.Timestamp)
+		}
 	}
 	l.EventStack = eventStack
+	l.Tombstone = tombstoneSyncMap
+
+	// Update the user and rebuild the index
+	index, err := NewSpatialIndex(l.config)
+	if err != nil {
+		return err
+	}
 
-	// Update the user
 	userSyncMap := &sync.Map{}
-	for key, value := range *tmp.User {
+	for key, value := range tmp.User {
+		if err := index.Insert(key, value.Lat, value.Long); err != nil {
+			return err
+		}
+
 		userSyncMap.Store(key, value)
 	}
 	l.User = userSyncMap
+	l.index = index
 
-	// Update the location
-	locationSyncMap := &sync.Map{}
-	for key, value := range *tmp.Location {
-		locationSyncMap.Store(key, value)
+	// Snapshots taken before the first sync have no offset
+	if tmp.Offset != "" {
+		l.offset = tmp.Offset
 	}
-	l.Location = locationSyncMap
 
 	return nil
 }
@@ -0,0 +1,459 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bengosborn/cue/helpers"
+	"github.com/redis/go-redis/v9"
+)
+
+// Location store shared by every instance through a redis geo set with last seen times in a sorted set and readings in a hash
+type LocationRedis struct {
+	ctx        context.Context
+	redis      *redis.Client
+	geoKey     string
+	seenKey    string
+	removeKey  string
+	readingKey string
+	ttl        time.Duration
+	skew       time.Duration
+	depth      uint
+	mutex      sync.RWMutex
+	listeners  []func(*UserData)
+	evicted    EvictionStats
+}
+
+const (
+	geoPrefix       = "location:geo"
+	seenPrefix      = "location:seen"
+	tombstonePrefix = "location:tombstone"
+	readingPrefix   = "location:reading"
+
+	// Redis geo sets only accept latitudes within the web mercator bounds
+	GeoLatLimit = 85.05112878
+
+	// Redis measures distances on a slightly larger sphere so searches are padded before filtering exactly
+	geoRadiusPadding = 1.001
+)
+
+// Apply an upsert unless it is older than the stored location or a removal of the user
+var upsertScript = redis.NewScript(`
+local seen = redis.call("ZSCORE", KEYS[2], ARGV[1])
+if seen and tonumber(seen) > tonumber(ARGV[4]) then
+	return 0
+end
+
+local removed = redis.call("ZSCORE", KEYS[3], ARGV[1])
+if removed and tonumber(removed) >= tonumber(ARGV[4]) then
+	return 0
+end
+
+redis.call("ZREM", KEYS[3], ARGV[1])
+redis.call("GEOADD", KEYS[1], ARGV[3], ARGV[2], ARGV[1])
+redis.call("ZADD", KEYS[2], ARGV[4], ARGV[1])
+
+if ARGV[5] == "" then
+	redis.call("HDEL", KEYS[4], ARGV[1])
+else
+	redis.call("HSET", KEYS[4], ARGV[1], ARGV[5])
+end
+
+return 1
+`)
+
+// Remove a user and leave a tombstone unless the user was updated after the removal
+var removeScript = redis.NewScript(`
+local seen = redis.call("ZSCORE", KEYS[2], ARGV[1])
+if seen and tonumber(seen) > tonumber(ARGV[2]) then
+	return 0
+end
+
+redis.call("ZREM", KEYS[1], ARGV[1])
+redis.call("ZREM", KEYS[2], ARGV[1])
+redis.call("HDEL", KEYS[4], ARGV[1])
+redis.call("ZADD", KEYS[3], ARGV[2], ARGV[1])
+
+return 1
+`)
+
+// Remove users and tombstones older than the cutoff and return how many were evicted
+var evictScript = redis.NewScript(`
+local cutoff = "(" .. ARGV[1]
+local users = redis.call("ZRANGEBYSCORE", KEYS[2], "-inf", cutoff)
+
+for _, user in ipairs(users) do
+	redis.call("ZREM", KEYS[1], user)
+	redis.call("HDEL", KEYS[4], user)
+end
+redis.call("ZREMRANGEBYSCORE", KEYS[2], "-inf", cutoff)
+
+local tombstones = redis.call("ZREMRANGEBYSCORE", KEYS[3], "-inf", cutoff)
+
+return {#users, tombstones}
+`)
+
+// Make a new redis backed location store which accepts timestamps up to the skew in the future
+func NewLocationRedis(ctx context.Context, id string, ttl time.Duration, skew time.Duration, redis *redis.Client, depth uint) (*LocationRedis, error) {
+	if depth == 0 {
+		depth = DefaultPartitionDepth
+	}
+
+	if depth > MaxPartitionDepth {
+		return nil, errors.New("partition depth out of bounds")
+	}
+
+	return &LocationRedis{
+		ctx:        ctx,
+		redis:      redis,
+		geoKey:     helpers.FormatKey(geoPrefix, id),
+		seenKey:    helpers.FormatKey(seenPrefix, id),
+		removeKey:  helpers.FormatKey(tombstonePrefix, id),
+		readingKey: helpers.FormatKey(readingPrefix, id),
+		ttl:        ttl,
+		skew:       skew,
+		depth:      depth,
+	}, nil
+}
+
+// Convert a time to the score stored in redis
+func toScore(timestamp time.Time) string {
+	return strconv.FormatInt(timestamp.UnixMilli(), 10)
+}
+
+// Validate a client reported fix within the bounds of the geo set
+func (l *LocationRedis) validate(fix *UserData, now time.Time) error {
+	if err := validateFix(fix, now, l.skew); err != nil {
+		return err
+	}
+
+	if math.Abs(fix.Lat) > GeoLatLimit {
+		return errors.New("latitude must be a number between -85.05112878 and 85.05112878")
+	}
+
+	return nil
+}
+
+// Encode the readings of a fix for the hash where no readings are empty
+func encodeReading(reading Reading) (string, error) {
+	if reading == (Reading{}) {
+		return "", nil
+	}
+
+	data, err := json.Marshal(reading)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// Decode the readings of a user from the hash
+func decodeReading(value interface{}) Reading {
+	reading := Reading{}
+
+	data, ok := value.(string)
+	if !ok {
+		return reading
+	}
+
+	// Unreadable readings are dropped rather than hiding the user
+	if err := json.Unmarshal([]byte(data), &reading); err != nil {
+		return Reading{}
+	}
+
+	return reading
+}
+
+// Add a new user
+func (l *LocationRedis) upsert(user string, fix *UserData) error {
+	reading, err := encodeReading(fix.Reading)
+	if err != nil {
+		return err
+	}
+
+	applied, err := upsertScript.Run(l.ctx, l.redis, []string{l.geoKey, l.seenKey, l.removeKey, l.readingKey}, user, fix.Lat, fix.Long, toScore(fix.Timestamp), reading).Int()
+	if err != nil {
+		return err
+	}
+
+	if applied == 0 {
+		return ErrStaleLocation
+	}
+
+	return nil
+}
+
+// Notify listeners of an applied upsert
+func (l *LocationRedis) notify(userData *UserData) {
+	l.mutex.RLock()
+	listeners := l.listeners
+	l.mutex.RUnlock()
+
+	for _, fn := range listeners {
+		fn(userData)
+	}
+}
+
+// Upsert a location at the time reported by the client and notify listeners
+func (l *LocationRedis) Upsert(user string, fix *UserData) error {
+	userData := fix.copyFor(user)
+
+	// Clients without a clock are stamped on arrival
+	now := time.Now()
+
+	if userData.Timestamp.IsZero() {
+		userData.Timestamp = now
+	}
+
+	if err := l.validate(userData, now); err != nil {
+		return err
+	}
+
+	if err := l.upsert(user, userData); err != nil {
+		return err
+	}
+
+	l.notify(userData)
+
+	return nil
+}
+
+// Upsert a batch of fixes for a user applying only the newest and returning the accepted fixes which were not applied
+func (l *LocationRedis) UpsertBatch(user string, fixes []*UserData) (*BatchResult, []*UserData, error) {
+	now := time.Now()
+
+	result, newest, err := validateBatch(user, fixes, func(fix *UserData) error {
+		return l.validate(fix, now)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if newest == -1 {
+		return result, make([]*UserData, 0), nil
+	}
+
+	applied := fixes[newest]
+	if err := l.upsert(user, applied); err == nil {
+		result.Applied = newest
+	} else if err != ErrStaleLocation {
+		return nil, nil, err
+	}
+
+	recorded := unappliedFixes(result, fixes)
+
+	if result.Applied != -1 {
+		l.notify(applied.copyFor(user))
+	}
+
+	return result, recorded, nil
+}
+
+// Remove a user so they are no longer visible to any instance
+func (l *LocationRedis) Remove(user string) error {
+	return removeScript.Run(l.ctx, l.redis, []string{l.geoKey, l.seenKey, l.removeKey, l.readingKey}, user, toScore(time.Now())).Err()
+}
+
+// Get the data for a given user
+func (l *LocationRedis) Get(user string) (*UserData, error) {
+	pipe := l.redis.Pipeline()
+	posCmd := pipe.GeoPos(l.ctx, l.geoKey, user)
+	seenCmd := pipe.ZScore(l.ctx, l.seenKey, user)
+	readingCmd := pipe.HGet(l.ctx, l.readingKey, user)
+
+	if _, err := pipe.Exec(l.ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	positions := posCmd.Val()
+	seen, err := seenCmd.Result()
+	if err == redis.Nil || len(positions) == 0 || positions[0] == nil {
+		return nil, errors.New("user does not exist")
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &UserData{User: user, Lat: positions[0].Latitude, Long: positions[0].Longitude, Timestamp: time.UnixMilli(int64(seen)), Reading: decodeReading(readingCmd.Val())}, nil
+}
+
+// Search the geo set within a radius in meters of a point
+func (l *LocationRedis) search(lat float64, long float64, radius float64) ([]redis.GeoLocation, error) {
+	// Search from the closest point the geo set accepts as the radius is widened to match
+	centerLat := math.Max(math.Min(lat, GeoLatLimit), -GeoLatLimit)
+	radius += Haversine(lat, long, centerLat, long)
+
+	return l.redis.GeoSearchLocation(l.ctx, l.geoKey, &redis.GeoSearchLocationQuery{
+		GeoSearchQuery: redis.GeoSearchQuery{Longitude: long, Latitude: centerLat, Radius: radius * geoRadiusPadding, RadiusUnit: "m"},
+		WithCoord:      true,
+	}).Result()
+}
+
+// Collect the fresh candidates matching the filter sorted by distance from a reference point excluding the user
+func (l *LocationRedis) collect(user string, candidates []redis.GeoLocation, lat float64, long float64, freshness time.Duration, filter func(*UserData) bool) ([]*NearbyUser, error) {
+	users := make([]*NearbyUser, 0)
+	if len(candidates) == 0 {
+		return users, nil
+	}
+
+	// Users older than the ttl are always stale
+	if freshness <= 0 || freshness > l.ttl {
+		freshness = l.ttl
+	}
+
+	names := make([]string, len(candidates))
+	for i, candidate := range candidates {
+		names[i] = candidate.Name
+	}
+
+	pipe := l.redis.Pipeline()
+	seenCmd := pipe.ZMScore(l.ctx, l.seenKey, names...)
+	readingCmd := pipe.HMGet(l.ctx, l.readingKey, names...)
+
+	if _, err := pipe.Exec(l.ctx); err != nil {
+		return nil, err
+	}
+
+	seen := seenCmd.Val()
+	readings := readingCmd.Val()
+
+	cutoff := time.Now().Add(-freshness)
+
+	for i, candidate := range candidates {
+		timestamp := time.UnixMilli(int64(seen[i]))
+		if candidate.Name == user || !timestamp.After(cutoff) {
+			continue
+		}
+
+		usrData := &UserData{User: candidate.Name, Lat: candidate.Latitude, Long: candidate.Longitude, Timestamp: timestamp, Reading: decodeReading(readings[i])}
+		if !filter(usrData) {
+			continue
+		}
+
+		partition, err := NewPartitionFromCoords(usrData.Lat, usrData.Long, l.depth)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, &NearbyUser{Data: usrData, Partition: partition, Distance: Haversine(lat, long, usrData.Lat, usrData.Long)})
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Distance < users[j].Distance
+	})
+
+	return users, nil
+}
+
+// Search the geo set for the users within a bounding box using the circle around its corners
+func (l *LocationRedis) searchBox(minLat float64, minLong float64, maxLat float64, maxLong float64) ([]redis.GeoLocation, float64, float64, error) {
+	centerLat, centerLong := BoxCenter(minLat, minLong, maxLat, maxLong)
+
+	radius := math.Max(
+		math.Max(Haversine(centerLat, centerLong, minLat, minLong), Haversine(centerLat, centerLong, minLat, maxLong)),
+		math.Max(Haversine(centerLat, centerLong, maxLat, minLong), Haversine(centerLat, centerLong, maxLat, maxLong)),
+	)
+
+	candidates, err := l.search(centerLat, centerLong, radius+1)
+
+	return candidates, centerLat, centerLong, err
+}
+
+// Get nearby users within a radius in meters seen within the freshness window sorted by distance
+func (l *LocationRedis) Nearby(user string, radius float64, freshness time.Duration) ([]*NearbyUser, error) {
+	userData, err := l.Get(user)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates, err := l.search(userData.Lat, userData.Long, radius)
+	if err != nil {
+		return nil, err
+	}
+
+	return l.collect(user, candidates, userData.Lat, userData.Long, freshness, func(usrData *UserData) bool {
+		return Haversine(userData.Lat, userData.Long, usrData.Lat, usrData.Long) <= radius
+	})
+}
+
+// Get users within a bounding box seen within the freshness window sorted by distance from the center of the box
+func (l *LocationRedis) Box(user string, minLat float64, minLong float64, maxLat float64, maxLong float64, freshness time.Duration) ([]*NearbyUser, error) {
+	candidates, centerLat, centerLong, err := l.searchBox(minLat, minLong, maxLat, maxLong)
+	if err != nil {
+		return nil, err
+	}
+
+	return l.collect(user, candidates, centerLat, centerLong, freshness, func(usrData *UserData) bool {
+		return InBox(usrData.Lat, usrData.Long, minLat, minLong, maxLat, maxLong)
+	})
+}
+
+// Get users within a polygon seen within the freshness window sorted by distance from the center of its bounds
+func (l *LocationRedis) Polygon(user string, points []*Point, freshness time.Duration) ([]*NearbyUser, error) {
+	// Find candidates within the bounds of the polygon then filter exactly
+	minLat, minLong, maxLat, maxLong := PolygonBounds(points)
+
+	candidates, _, _, err := l.searchBox(minLat, minLong, maxLat, maxLong)
+	if err != nil {
+		return nil, err
+	}
+
+	return l.collect(user, candidates, (minLat+maxLat)/2, (minLong+maxLong)/2, freshness, func(usrData *UserData) bool {
+		return InPolygon(usrData.Lat, usrData.Long, points)
+	})
+}
+
+// Register a function to be called after every local upsert
+func (l *LocationRedis) OnUpsert(fn func(*UserData)) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.listeners = append(l.listeners, fn)
+}
+
+// Every instance reads and writes the shared state directly so there is nothing to sync
+func (l *LocationRedis) Sync() error {
+	return nil
+}
+
+// The shared state is already persisted in redis
+func (l *LocationRedis) Snapshot() error {
+	return nil
+}
+
+// The shared state is available as soon as the instance starts
+func (l *LocationRedis) Restore() error {
+	return nil
+}
+
+// Remove expired users and tombstones and return how many were evicted
+func (l *LocationRedis) Evict() (*EvictionStats, error) {
+	counts, err := evictScript.Run(l.ctx, l.redis, []string{l.geoKey, l.seenKey, l.removeKey, l.readingKey}, toScore(time.Now().Add(-l.ttl))).Int64Slice()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &EvictionStats{Users: int(counts[0]), Tombstones: int(counts[1])}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.evicted.Users += stats.Users
+	l.evicted.Tombstones += stats.Tombstones
+
+	return stats, nil
+}
+
+// Total number of entries evicted by this instance since the store was created
+func (l *LocationRedis) Evicted() EvictionStats {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	return l.evicted
+}
@@ -0,0 +1,264 @@
+package utils
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bengosborn/cue/helpers"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// Connect to the redis at REDIS_URL or skip the test when none is reachable
+func testRedis(t *testing.T) *redis.Client {
+	t.Helper()
+
+	url := os.Getenv("REDIS_URL")
+	if url == "" {
+		t.Skip("REDIS_URL is not set")
+	}
+
+	client, err := helpers.NewRedis(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		t.Skipf("redis is not reachable: %v", err)
+	}
+
+	t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+// Make a redis location store under a unique id whose keys are deleted after the test
+func testLocationRedis(t *testing.T, ttl time.Duration) *LocationRedis {
+	t.Helper()
+
+	client := testRedis(t)
+
+	location, err := NewLocationRedis(context.Background(), uuid.NewString(), ttl, time.Second, client, DefaultPartitionDepth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		client.Del(context.Background(), location.geoKey, location.seenKey, location.removeKey, location.readingKey)
+	})
+
+	return location
+}
+
+func TestLocationRedisUpsertGet(t *testing.T) {
+	location := testLocationRedis(t, time.Minute)
+
+	accuracy := 12.5
+	now := time.Now().Truncate(time.Millisecond)
+
+	if err := location.Upsert("a", &UserData{Lat: 37.7749, Long: -122.4194, Timestamp: now, Reading: Reading{Accuracy: &accuracy}}); err != nil {
+		t.Fatal(err)
+	}
+
+	userData, err := location.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if userData.User != "a" || Haversine(userData.Lat, userData.Long, 37.7749, -122.4194) > 1 || !userData.Timestamp.Equal(now) {
+		t.Fatalf("got %+v", userData)
+	}
+
+	if userData.Accuracy == nil || *userData.Accuracy != accuracy || userData.Altitude != nil {
+		t.Fatalf("got readings %+v", userData.Reading)
+	}
+
+	// Older fixes are dropped
+	if err := location.Upsert("a", &UserData{Lat: 37.8, Long: -122.4, Timestamp: now.Add(-time.Second)}); err != ErrStaleLocation {
+		t.Fatalf("got %v upserting an older fix, want %v", err, ErrStaleLocation)
+	}
+
+	if _, err := location.Get("b"); err == nil {
+		t.Fatal("got no error for an unknown user")
+	}
+}
+
+func TestLocationRedisGeoLimit(t *testing.T) {
+	location := testLocationRedis(t, time.Minute)
+
+	if err := location.Upsert("a", &UserData{Lat: 89, Long: 0}); err == nil {
+		t.Fatal("got no error for a latitude outside the geo set")
+	}
+}
+
+func TestLocationRedisNearby(t *testing.T) {
+	location := testLocationRedis(t, time.Minute)
+
+	fixes := map[string]*UserData{
+		"a": {Lat: 37.7749, Long: -122.4194},
+		"b": {Lat: 37.7760, Long: -122.4194},
+		"c": {Lat: 37.8049, Long: -122.4194},
+		"d": {Lat: 40.7128, Long: -74.0060},
+	}
+
+	for user, fix := range fixes {
+		if err := location.Upsert(user, fix); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	nearby, err := location.Nearby("a", 5000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(nearby) != 2 || nearby[0].Data.User != "b" || nearby[1].Data.User != "c" {
+		t.Fatalf("got %d nearby users", len(nearby))
+	}
+
+	if nearby[0].Distance > nearby[1].Distance || len(nearby[0].Partition.Encoded) != DefaultPartitionDepth {
+		t.Fatalf("got nearby users out of order or at the wrong depth")
+	}
+
+	box, err := location.Box("a", 37.77, -122.42, 37.78, -122.41, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(box) != 1 || box[0].Data.User != "b" {
+		t.Fatalf("got %d users in the box", len(box))
+	}
+
+	polygon, err := location.Polygon("", []*Point{{Lat: 37.77, Long: -122.43}, {Lat: 37.81, Long: -122.43}, {Lat: 37.81, Long: -122.41}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := make([]string, len(polygon))
+	for i, user := range polygon {
+		users[i] = user.Data.User
+	}
+
+	sameUsers(t, users, []string{"a", "b", "c"})
+}
+
+func TestLocationRedisFreshness(t *testing.T) {
+	location := testLocationRedis(t, time.Minute)
+
+	if err := location.Upsert("a", &UserData{Lat: 37.7749, Long: -122.4194}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := location.Upsert("b", &UserData{Lat: 37.7760, Long: -122.4194, Timestamp: time.Now().Add(-30 * time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+
+	nearby, err := location.Nearby("a", 5000, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(nearby) != 0 {
+		t.Fatalf("got %d users seen within the window, want 0", len(nearby))
+	}
+
+	nearby, err = location.Nearby("a", 5000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(nearby) != 1 {
+		t.Fatalf("got %d users seen within the ttl, want 1", len(nearby))
+	}
+}
+
+func TestLocationRedisRemove(t *testing.T) {
+	location := testLocationRedis(t, time.Minute)
+
+	before := time.Now().Add(-time.Second)
+	if err := location.Upsert("a", &UserData{Lat: 37.7749, Long: -122.4194, Timestamp: before}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := location.Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := location.Get("a"); err == nil {
+		t.Fatal("got a removed user")
+	}
+
+	// Fixes from before the removal cannot bring the user back
+	if err := location.Upsert("a", &UserData{Lat: 37.7749, Long: -122.4194, Timestamp: before}); err != ErrStaleLocation {
+		t.Fatalf("got %v upserting a fix older than the removal, want %v", err, ErrStaleLocation)
+	}
+
+	if err := location.Upsert("a", &UserData{Lat: 37.7749, Long: -122.4194, Timestamp: time.Now().Add(time.Millisecond)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLocationRedisUpsertBatch(t *testing.T) {
+	location := testLocationRedis(t, time.Minute)
+
+	now := time.Now().Truncate(time.Millisecond)
+	fixes := []*UserData{
+		{Lat: 37.7749, Long: -122.4194, Timestamp: now.Add(-2 * time.Second)},
+		{Lat: 37.7760, Long: -122.4194, Timestamp: now},
+		{Lat: 100, Long: -122.4194, Timestamp: now},
+		{Lat: 37.7755, Long: -122.4194, Timestamp: now.Add(-time.Second)},
+	}
+
+	result, recorded, err := location.UpsertBatch("a", fixes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Applied != 1 || len(result.Rejected) != 1 || result.Rejected[0].Index != 2 || len(recorded) != 2 {
+		t.Fatalf("got %+v with %d recorded fixes", result, len(recorded))
+	}
+
+	userData, err := location.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !userData.Timestamp.Equal(now) {
+		t.Fatalf("got the fix at %v, want the newest at %v", userData.Timestamp, now)
+	}
+}
+
+func TestLocationRedisEvict(t *testing.T) {
+	location := testLocationRedis(t, time.Second)
+
+	if err := location.Upsert("a", &UserData{Lat: 37.7749, Long: -122.4194, Timestamp: time.Now().Add(-2 * time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := location.Upsert("b", &UserData{Lat: 37.7760, Long: -122.4194}); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := location.Evict()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Users != 1 || location.Evicted().Users != 1 {
+		t.Fatalf("got %+v evicted, want 1 user", stats)
+	}
+
+	if _, err := location.Get("a"); err == nil {
+		t.Fatal("got an evicted user")
+	}
+
+	if _, err := location.Get("b"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Storage backend for the locations of users
+type LocationStore interface {
+	Upsert(user string, fix *UserData) error
+	UpsertBatch(user string, fixes []*UserData) (*BatchResult, []*UserData, error)
+	Remove(user string) error
+	Get(user string) (*UserData, error)
+	Nearby(user string, radius float64, freshness time.Duration) ([]*NearbyUser, error)
+	Box(user string, minLat float64, minLong float64, maxLat float64, maxLong float64, freshness time.Duration) ([]*NearbyUser, error)
+	Polygon(user string, points []*Point, freshness time.Duration) ([]*NearbyUser, error)
+	OnUpsert(fn func(*UserData))
+	Sync() error
+	Snapshot() error
+	Restore() error
+	Evict() (*EvictionStats, error)
+	Evicted() EvictionStats
+}
+
+// Names of the available location stores
+const (
+	LocationStoreMemory = "memory"
+	LocationStoreRedis  = "redis"
+)
+
+// Make the location store with the given name which defaults to the in memory store
+func NewLocationStore(ctx context.Context, name string, id string, ttl time.Duration, skew time.Duration, redis *redis.Client, config *SpatialIndexConfig) (LocationStore, error) {
+	switch name {
+	case "", LocationStoreMemory:
+		location, err := NewLocation(ctx, id, ttl, skew, redis, config)
+		if err != nil {
+			return nil, err
+		}
+
+		return location, nil
+
+	case LocationStoreRedis:
+		location, err := NewLocationRedis(ctx, id, ttl, skew, redis, config.Depth)
+		if err != nil {
+			return nil, err
+		}
+
+		return location, nil
+
+	default:
+		return nil, errors.New("unknown location store")
+	}
+}
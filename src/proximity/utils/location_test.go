@@ -0,0 +1,169 @@
+package utils
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis client for syncing which uses REDIS_URL when set and otherwise fails every call so only the local locking is exercised
+func stressRedis(t *testing.T) *redis.Client {
+	t.Helper()
+
+	if os.Getenv("REDIS_URL") != "" {
+		return testRedis(t)
+	}
+
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1, DialTimeout: 10 * time.Millisecond})
+	t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+// Run with go test -race to check the store under concurrent upserts, queries and syncs
+func TestLocationConcurrentStress(t *testing.T) {
+	const (
+		workers = 8
+		rounds  = 200
+		users   = 50
+		syncs   = 5
+	)
+
+	for name, config := range spatialIndexConfigs {
+		t.Run(name, func(t *testing.T) {
+			location, err := NewLocation(context.Background(), uuid.NewString(), time.Minute, time.Second, stressRedis(t), config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var notified sync.Map
+			location.OnUpsert(func(userData *UserData) {
+				notified.Store(userData.User, true)
+			})
+
+			var wg sync.WaitGroup
+			errs := make(chan error, workers*4)
+
+			for worker := 0; worker < workers; worker++ {
+				wg.Add(4)
+
+				// Writers move users around a small area so queries keep finding them
+				go func(seed int64) {
+					defer wg.Done()
+
+					rng := rand.New(rand.NewSource(seed))
+					for i := 0; i < rounds; i++ {
+						user := strconv.Itoa(rng.Intn(users))
+						fix := &UserData{Lat: 37.7 + rng.Float64()*0.1, Long: -122.5 + rng.Float64()*0.1}
+
+						switch rng.Intn(10) {
+						case 0:
+							if err := location.Remove(user); err != nil {
+								errs <- err
+								return
+							}
+						case 1:
+							if _, _, err := location.UpsertBatch(user, []*UserData{fix, {Lat: fix.Lat, Long: fix.Long, Timestamp: time.Now().Add(-time.Second)}}); err != nil {
+								errs <- err
+								return
+							}
+						default:
+							if err := location.Upsert(user, fix); err != nil && err != ErrStaleLocation {
+								errs <- err
+								return
+							}
+						}
+					}
+				}(int64(worker))
+
+				// Readers query by radius, box and polygon while users move
+				go func(seed int64) {
+					defer wg.Done()
+
+					rng := rand.New(rand.NewSource(seed))
+					for i := 0; i < rounds; i++ {
+						user := strconv.Itoa(rng.Intn(users))
+
+						if _, err := location.Nearby(user, 5000, 0); err != nil && err.Error() != "user does not exist" {
+							errs <- err
+							return
+						}
+
+						if _, err := location.Box(user, 37.7, -122.5, 37.8, -122.4, 0); err != nil {
+							errs <- err
+							return
+						}
+
+						if _, err := location.Polygon(user, []*Point{{Lat: 37.7, Long: -122.5}, {Lat: 37.8, Long: -122.5}, {Lat: 37.8, Long: -122.4}}, 0); err != nil {
+							errs <- err
+							return
+						}
+
+						location.Get(user)
+					}
+				}(int64(workers + worker))
+
+				// Syncs fail without redis but still contend for the event stack
+				go func() {
+					defer wg.Done()
+
+					for i := 0; i < syncs; i++ {
+						location.Sync()
+					}
+				}()
+
+				// Evictions and serialization walk every user
+				go func() {
+					defer wg.Done()
+
+					for i := 0; i < syncs; i++ {
+						if _, err := location.Evict(); err != nil {
+							errs <- err
+							return
+						}
+
+						if _, err := location.MarshalJSON(); err != nil {
+							errs <- err
+							return
+						}
+					}
+				}()
+			}
+
+			wg.Wait()
+			close(errs)
+
+			for err := range errs {
+				t.Fatal(err)
+			}
+
+			// Every indexed user is stored and inside the area
+			nearby, err := location.Box("", 37.7, -122.5, 37.8, -122.4, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, user := range nearby {
+				if _, ok := notified.Load(user.Data.User); !ok {
+					t.Fatalf("user %s was indexed without being notified", user.Data.User)
+				}
+
+				stored, err := location.Get(user.Data.User)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if stored.Lat != user.Data.Lat || stored.Long != user.Data.Long {
+					t.Fatalf("user %s is indexed away from the stored location", user.Data.User)
+				}
+			}
+		})
+	}
+}
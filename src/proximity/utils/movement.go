@@ -0,0 +1,264 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/bengosborn/cue/helpers"
+	"github.com/redis/go-redis/v9"
+)
+
+// Policy for fixes which imply impossible movement since the previous fix
+type MovementPolicy struct {
+	ctx      context.Context
+	redis    *redis.Client
+	ttl      time.Duration
+	Action   string
+	MaxSpeed float64
+}
+
+// Fix which moved faster than allowed from the previous fix of the user
+type MovementViolation struct {
+	User     string    `json:"user"`
+	From     *UserData `json:"from"`
+	To       *UserData `json:"to"`
+	Distance float64   `json:"distance"`
+	Speed    float64   `json:"speed"`
+	MaxSpeed float64   `json:"maxSpeed"`
+	Action   string    `json:"action"`
+	index    int
+}
+
+// Actions taken on impossible movement
+const (
+	MovementIgnore = "ignore"
+	MovementFlag   = "flag"
+	MovementReject = "reject"
+)
+
+// Bounds for movement checks where speeds are in meters per second and distances in meters
+const (
+	DefaultMaxSpeed = 300
+
+	// Jumps shorter than this are treated as gps noise however quickly they happen
+	movementJitter = 100
+
+	// Timestamps are kept to the millisecond
+	movementResolution = time.Millisecond
+)
+
+// Last fix of each user shared by every shard and group
+const movementLastPrefix = "movement:last"
+
+// Returned when a fix implies impossible movement under the reject policy
+var ErrImpossibleMovement = errors.New("movement is faster than allowed")
+
+// Record the last fix of a user unless a newer one is already recorded
+var recordMovementScript = redis.NewScript(`
+local timestamp = redis.call("HGET", KEYS[1], "timestamp")
+if timestamp and tonumber(timestamp) >= tonumber(ARGV[3]) then
+	return 0
+end
+
+redis.call("HSET", KEYS[1], "lat", ARGV[1], "long", ARGV[2], "timestamp", ARGV[3])
+redis.call("PEXPIRE", KEYS[1], ARGV[4])
+
+return 1
+`)
+
+// Make a new movement policy where an empty action ignores movement and a zero speed uses the default where last fixes are kept for the ttl
+func NewMovementPolicy(ctx context.Context, redis *redis.Client, ttl time.Duration, action string, maxSpeed float64) (*MovementPolicy, error) {
+	switch action {
+	case "":
+		action = MovementIgnore
+	case MovementIgnore, MovementFlag, MovementReject:
+	default:
+		return nil, errors.New("unknown movement policy")
+	}
+
+	if maxSpeed == 0 {
+		maxSpeed = DefaultMaxSpeed
+	}
+
+	if maxSpeed < 0 {
+		return nil, errors.New("max speed out of bounds")
+	}
+
+	return &MovementPolicy{ctx: ctx, redis: redis, ttl: ttl, Action: action, MaxSpeed: maxSpeed}, nil
+}
+
+// Get the last recorded fix of a user which is nil for users without one
+func (m *MovementPolicy) Previous(user string) (*UserData, error) {
+	if m.Action == MovementIgnore {
+		return nil, nil
+	}
+
+	values, err := m.redis.HGetAll(m.ctx, helpers.FormatKey(movementLastPrefix, user)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	lat, err := strconv.ParseFloat(values["lat"], 64)
+	if err != nil {
+		return nil, err
+	}
+
+	long, err := strconv.ParseFloat(values["long"], 64)
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp, err := strconv.ParseInt(values["timestamp"], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UserData{User: user, Lat: lat, Long: long, Timestamp: time.UnixMilli(timestamp)}, nil
+}
+
+// Record the last fix of a user so the next fix is checked against it on any shard
+func (m *MovementPolicy) Record(user string, fix *UserData) error {
+	if m.Action == MovementIgnore || fix == nil {
+		return nil
+	}
+
+	lat := strconv.FormatFloat(fix.Lat, 'f', -1, 64)
+	long := strconv.FormatFloat(fix.Long, 'f', -1, 64)
+
+	return recordMovementScript.Run(m.ctx, m.redis, []string{helpers.FormatKey(movementLastPrefix, user)}, lat, long, fix.Timestamp.UnixMilli(), m.ttl.Milliseconds()).Err()
+}
+
+// Check the movement from the previous fix to the next one and return the violation if it is too fast
+func (m *MovementPolicy) Check(user string, prev *UserData, next *UserData) *MovementViolation {
+	// Older fixes are dropped by the stores but fixes at the same time replace the stored one
+	if m.Action == MovementIgnore || prev == nil || next == nil || !inBounds(next.Lat, next.Long) || next.Timestamp.Before(prev.Timestamp) {
+		return nil
+	}
+
+	distance := Haversine(prev.Lat, prev.Long, next.Lat, next.Long)
+	if distance <= movementJitter {
+		return nil
+	}
+
+	// A jump at the same time is measured over the shortest interval timestamps can tell apart so it is never allowed
+	elapsed := next.Timestamp.Sub(prev.Timestamp)
+	if elapsed < movementResolution {
+		elapsed = movementResolution
+	}
+
+	speed := distance / elapsed.Seconds()
+	if speed <= m.MaxSpeed {
+		return nil
+	}
+
+	return &MovementViolation{
+		User:     user,
+		From:     &UserData{User: user, Lat: prev.Lat, Long: prev.Long, Timestamp: prev.Timestamp},
+		To:       &UserData{User: user, Lat: next.Lat, Long: next.Long, Timestamp: next.Timestamp},
+		Distance: distance,
+		Speed:    speed,
+		MaxSpeed: m.MaxSpeed,
+		Action:   m.Action,
+	}
+}
+
+// Check a batch of fixes in time order starting from the previous fix where rejected fixes do not move the user
+func (m *MovementPolicy) CheckBatch(user string, prev *UserData, fixes []*UserData) []*MovementViolation {
+	violations := make([]*MovementViolation, 0)
+	if m.Action == MovementIgnore {
+		return violations
+	}
+
+	order := make([]int, 0, len(fixes))
+	for i, fix := range fixes {
+		// Invalid fixes are rejected by the store instead
+		if fix != nil && !fix.Timestamp.IsZero() && inBounds(fix.Lat, fix.Long) {
+			order = append(order, i)
+		}
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		return fixes[order[i]].Timestamp.Before(fixes[order[j]].Timestamp)
+	})
+
+	for _, i := range order {
+		violation := m.Check(user, prev, fixes[i])
+		if violation != nil {
+			violation.index = i
+			violations = append(violations, violation)
+
+			if m.Action == MovementReject {
+				continue
+			}
+		}
+
+		if prev == nil || fixes[i].Timestamp.After(prev.Timestamp) {
+			prev = fixes[i]
+		}
+	}
+
+	return violations
+}
+
+// Upsert the fixes of a batch which were not rejected for impossible movement and report the rejected fixes by their index in the batch
+func (m *MovementPolicy) UpsertBatch(location LocationStore, user string, fixes []*UserData, violations []*MovementViolation) (*BatchResult, []*UserData, error) {
+	if m.Action != MovementReject || len(violations) == 0 || len(fixes) > MaxBatchSize {
+		return location.UpsertBatch(user, fixes)
+	}
+
+	rejected := make(map[int]bool)
+	for _, violation := range violations {
+		rejected[violation.index] = true
+	}
+
+	// Indexes of the kept fixes in the original batch
+	kept := make([]*UserData, 0, len(fixes))
+	indexes := make([]int, 0, len(fixes))
+	for i, fix := range fixes {
+		if !rejected[i] {
+			kept = append(kept, fix)
+			indexes = append(indexes, i)
+		}
+	}
+
+	result := &BatchResult{Applied: -1, Accepted: make([]int, 0), Rejected: make([]*BatchRejection, 0)}
+	recorded := make([]*UserData, 0)
+
+	if len(kept) > 0 {
+		var err error
+
+		result, recorded, err = location.UpsertBatch(user, kept)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if result.Applied != -1 {
+			result.Applied = indexes[result.Applied]
+		}
+
+		for i := range result.Accepted {
+			result.Accepted[i] = indexes[result.Accepted[i]]
+		}
+
+		for _, rejection := range result.Rejected {
+			rejection.Index = indexes[rejection.Index]
+		}
+	}
+
+	for i := range rejected {
+		result.Rejected = append(result.Rejected, &BatchRejection{Index: i, Reason: ErrImpossibleMovement.Error()})
+	}
+
+	sort.Slice(result.Rejected, func(i, j int) bool {
+		return result.Rejected[i].Index < result.Rejected[j].Index
+	})
+
+	return result, recorded, nil
+}
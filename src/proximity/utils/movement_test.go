@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/bengosborn/cue/helpers"
+	"github.com/google/uuid"
+)
+
+func TestMovementCheckSameTimestamp(t *testing.T) {
+	movement, err := NewMovementPolicy(context.Background(), nil, time.Minute, MovementReject, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	newYork := &UserData{Lat: 40.7128, Long: -74.0060, Timestamp: now}
+	tokyo := &UserData{Lat: 35.6762, Long: 139.6503, Timestamp: now}
+
+	// A teleport at the same time is caught
+	violation := movement.Check("a", newYork, tokyo)
+	if violation == nil || violation.Speed <= movement.MaxSpeed {
+		t.Fatalf("got %+v for a jump at the same time", violation)
+	}
+
+	if _, err := json.Marshal(violation); err != nil {
+		t.Fatal(err)
+	}
+
+	// Noise at the same time and older fixes are not violations
+	if violation := movement.Check("a", newYork, &UserData{Lat: 40.7129, Long: -74.0060, Timestamp: now}); violation != nil {
+		t.Fatalf("got %+v for jitter at the same time", violation)
+	}
+
+	if violation := movement.Check("a", newYork, &UserData{Lat: tokyo.Lat, Long: tokyo.Long, Timestamp: now.Add(-time.Second)}); violation != nil {
+		t.Fatalf("got %+v for an older fix", violation)
+	}
+
+	// Fixes of a batch sharing a timestamp are checked against each other
+	violations := movement.CheckBatch("a", nil, []*UserData{newYork, tokyo})
+	if len(violations) != 1 || violations[0].index != 1 {
+		t.Fatalf("got %d violations for a batch jumping at the same time", len(violations))
+	}
+}
+
+func TestMovementRecordPrevious(t *testing.T) {
+	client := testRedis(t)
+
+	movement, err := NewMovementPolicy(context.Background(), client, time.Minute, MovementFlag, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := uuid.NewString()
+	t.Cleanup(func() { client.Del(context.Background(), helpers.FormatKey(movementLastPrefix, user)) })
+
+	if prev, err := movement.Previous(user); err != nil || prev != nil {
+		t.Fatalf("got %+v, %v for a user without fixes", prev, err)
+	}
+
+	now := time.Now().Truncate(time.Millisecond)
+	if err := movement.Record(user, &UserData{Lat: 37.774912, Long: -122.419415, Timestamp: now}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Older fixes never replace the last fix
+	if err := movement.Record(user, &UserData{Lat: 51.5, Long: -0.12, Timestamp: now.Add(-time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+
+	prev, err := movement.Previous(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if prev == nil || prev.Lat != 37.774912 || prev.Long != -122.419415 || !prev.Timestamp.Equal(now) {
+		t.Fatalf("got %+v, want the newest fix", prev)
+	}
+
+	// A jump from the recorded fix is caught whichever store holds the user
+	if violation := movement.Check(user, prev, &UserData{Lat: 51.5, Long: -0.12, Timestamp: now.Add(time.Minute)}); violation == nil {
+		t.Fatal("got no violation for an impossible jump")
+	}
+}
@@ -1,7 +1,6 @@
 package utils
 
 import (
-	"container/list"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -20,13 +19,17 @@ type Partition struct {
 
 // Depth of the partitioning e.g. the size of each partition
 const (
-	PartitionDepth = 10
-	LatMin         = -90
-	LatMax         = 90
-	LongMin        = -180
-	LongMax        = 180
+	DefaultPartitionDepth = 10
+	MaxPartitionDepth     = 20
+	LatMin                = -90
+	LatMax                = 90
+	LongMin               = -180
+	LongMax               = 180
 )
 
+// Returned when a translation would cross a pole
+var ErrPartitionPole = errors.New("partition translated past a pole")
+
 // Translate directions
 type Direction int
 
@@ -38,12 +41,12 @@ const (
 )
 
 // Partition a given latitude and longitude
-func partition(lat float32, long float32, latMin float32, latMax float32, longMin float32, longMax float32, depth uint) (string, *[]*chunk, error) {
+func partition(lat float64, long float64, latMin float64, latMax float64, longMin float64, longMax float64, depth uint) (string, *[]*chunk, error) {
 	buffer := strings.Builder{}
 	chunks := make([]*chunk, depth)
 
-	var recurse func(float32, float32, float32, float32, uint) error
-	recurse = func(latMin float32, latMax float32, longMin float32, longMax float32, depth uint) error {
+	var recurse func(float64, float64, float64, float64, uint) error
+	recurse = func(latMin float64, latMax float64, longMin float64, longMax float64, depth uint) error {
 		// Base case
 		if depth <= 0 {
 			return nil
@@ -57,8 +60,8 @@ func partition(lat float32, long float32, latMin float32, latMax float32, longMi
 		midLat := (latMin + latMax) / 2
 
 		y := 0
-		var newLatMin float32
-		var newLatMax float32
+		var newLatMin float64
+		var newLatMax float64
 
 		if lat < midLat {
 			newLatMin = latMin
@@ -73,8 +76,8 @@ func partition(lat float32, long float32, latMin float32, latMax float32, longMi
 		midLong := (longMin + longMax) / 2
 
 		x := 0
-		var newLongMin float32
-		var newLongMax float32
+		var newLongMin float64
+		var newLongMax float64
 
 		if long < midLong {
 			newLongMin = longMin
@@ -103,9 +106,9 @@ func partition(lat float32, long float32, latMin float32, latMax float32, longMi
 	return buffer.String(), &chunks, nil
 }
 
-// Create a new partition from a latitude and longitude
-func NewPartitionFromCoords(lat float32, long float32) (*Partition, error) {
-	encoded, chunks, err := partition(lat, long, LatMin, LatMax, LongMin, LongMax, PartitionDepth)
+// Create a new partition from a latitude and longitude at a given depth
+func NewPartitionFromCoords(lat float64, long float64, depth uint) (*Partition, error) {
+	encoded, chunks, err := partition(lat, long, LatMin, LatMax, LongMin, LongMax, depth)
 	if err != nil {
 		return nil, err
 	}
@@ -164,7 +167,7 @@ func (p *Partition) Contains(partition *Partition) bool {
 	return strings.Contains(partition.Encoded, p.Encoded)
 }
 
-// Translate a partition string in some direction
+// Translate a partition string in some direction where longitude wraps across the antimeridian and latitude stops at the poles
 func (p *Partition) Translate(direction Direction) (*Partition, error) {
 	var remainderY int
 	var remainderX int
@@ -223,6 +226,11 @@ func (p *Partition) Translate(direction Direction) (*Partition, error) {
 		newChunks[i] = &chunk{X: newX, Y: newY}
 	}
 
+	// A remaining latitude carry means the translation ran off the grid at a pole
+	if remainderY != 0 {
+		return nil, ErrPartitionPole
+	}
+
 	newPartition, err := NewPartitonFromChunks(&newChunks)
 	if err != nil {
 		return nil, err
@@ -231,64 +239,11 @@ func (p *Partition) Translate(direction Direction) (*Partition, error) {
 	return newPartition, nil
 }
 
-type queueNode struct {
-	remaining int
-	partition *Partition
-}
-
-// Find all nearby partitions within a given radius
-func (p *Partition) Nearby(radius int) (*[]*Partition, error) {
-	out := make([]*Partition, 0)
-
-	seen := make(map[string]bool)
-	queue := list.New()
-	queue.PushBack(&queueNode{remaining: radius, partition: p})
-
-	// BFS for surrounding partitons
-	for queue.Len() > 0 {
-		current := queue.Front()
-		node := current.Value.(*queueNode)
-		queue.Remove(current)
-
-		// No duplicates
-		if _, ok := seen[node.partition.Encoded]; ok {
-			continue
-		}
-		seen[node.partition.Encoded] = true
-
-		out = append(out, node.partition)
-
-		// Identify nearby partitions
-		if node.remaining <= 0 {
-			continue
-		}
-
-		addPartition := func(direction Direction) error {
-			partition, err := node.partition.Translate(direction)
-			if err != nil {
-				return err
-			}
-
-			queue.PushBack(&queueNode{remaining: node.remaining - 1, partition: partition})
-
-			return nil
-		}
-
-		if err := addPartition(DirUp); err != nil {
-			return nil, err
-		}
-		if err := addPartition(DirDown); err != nil {
-			return nil, err
-		}
-		if err := addPartition(DirLeft); err != nil {
-			return nil, err
-		}
-		if err := addPartition(DirRight); err != nil {
-			return nil, err
-		}
-	}
+// Size of a partition in degrees at a given depth
+func PartitionSize(depth uint) (float64, float64) {
+	cells := float64(uint(1) << depth)
 
-	return &out, nil
+	return (LatMax - LatMin) / cells, (LongMax - LongMin) / cells
 }
 
 func (p *Partition) MarshalJSON() ([]byte, error) {
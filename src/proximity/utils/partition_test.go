@@ -0,0 +1,229 @@
+package utils
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"testing"
+	"testing/quick"
+)
+
+// Random partition inputs generated by quick where coordinates are scaled into bounds
+type partitionInput struct {
+	Lat   uint32
+	Long  uint32
+	Depth uint8
+}
+
+func (in partitionInput) coords() (float64, float64, uint) {
+	lat := LatMin + float64(in.Lat)/math.MaxUint32*(LatMax-LatMin)
+	long := LongMin + float64(in.Long)/math.MaxUint32*(LongMax-LongMin)
+
+	return lat, long, uint(in.Depth)%MaxPartitionDepth + 1
+}
+
+var partitionQuickConfig = &quick.Config{MaxCount: 2000, Rand: rand.New(rand.NewSource(5))}
+
+// Find the bounds of a partition from its chunks
+func partitionBounds(p *Partition) (float64, float64, float64, float64) {
+	latMin, latMax := float64(LatMin), float64(LatMax)
+	longMin, longMax := float64(LongMin), float64(LongMax)
+
+	chunks := *p.Chunks
+	for i := len(chunks) - 1; i >= 0; i-- {
+		midLat := (latMin + latMax) / 2
+		if chunks[i].Y == 0 {
+			latMax = midLat
+		} else {
+			latMin = midLat
+		}
+
+		midLong := (longMin + longMax) / 2
+		if chunks[i].X == 0 {
+			longMax = midLong
+		} else {
+			longMin = midLong
+		}
+	}
+
+	return latMin, longMin, latMax, longMax
+}
+
+// Find the center of a partition from its chunks
+func partitionCenter(p *Partition) (float64, float64) {
+	latMin, longMin, latMax, longMax := partitionBounds(p)
+
+	return (latMin + latMax) / 2, (longMin + longMax) / 2
+}
+
+func TestPartitionEncodedRoundTrip(t *testing.T) {
+	property := func(in partitionInput) bool {
+		lat, long, depth := in.coords()
+
+		partition, err := NewPartitionFromCoords(lat, long, depth)
+		if err != nil || len(partition.Encoded) != int(depth) {
+			return false
+		}
+
+		// The coordinates fall inside the partition
+		latMin, longMin, latMax, longMax := partitionBounds(partition)
+		if lat < latMin || lat > latMax || long < longMin || long > longMax {
+			return false
+		}
+
+		decoded, err := NewPartitionFromEncoded(partition.Encoded)
+		if err != nil {
+			return false
+		}
+
+		encoded, err := NewPartitonFromChunks(decoded.Chunks)
+		if err != nil || encoded.Encoded != partition.Encoded {
+			return false
+		}
+
+		// Re-encoding the center gives back the same partition
+		centerLat, centerLong := partitionCenter(partition)
+		center, err := NewPartitionFromCoords(centerLat, centerLong, depth)
+
+		return err == nil && center.Encoded == partition.Encoded
+	}
+
+	if err := quick.Check(property, partitionQuickConfig); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPartitionTranslateInverse(t *testing.T) {
+	opposite := map[Direction]Direction{DirUp: DirDown, DirDown: DirUp, DirLeft: DirRight, DirRight: DirLeft}
+
+	property := func(in partitionInput) bool {
+		partition, err := NewPartitionFromCoords(in.coords())
+		if err != nil {
+			return false
+		}
+
+		for direction, back := range opposite {
+			moved, err := partition.Translate(direction)
+			if errors.Is(err, ErrPartitionPole) {
+				continue
+			}
+
+			if err != nil || moved.Encoded == partition.Encoded {
+				return false
+			}
+
+			returned, err := moved.Translate(back)
+			if err != nil || returned.Encoded != partition.Encoded {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	if err := quick.Check(property, partitionQuickConfig); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPartitionTranslateMatchesCoords(t *testing.T) {
+	property := func(in partitionInput) bool {
+		partition, err := NewPartitionFromCoords(in.coords())
+		if err != nil {
+			return false
+		}
+
+		depth := uint(len(partition.Encoded))
+		latSize, longSize := PartitionSize(depth)
+		centerLat, centerLong := partitionCenter(partition)
+
+		// Up moves towards lower latitudes as the partition rows count up from the south pole
+		offsets := map[Direction][2]float64{
+			DirUp:    {-latSize, 0},
+			DirDown:  {latSize, 0},
+			DirLeft:  {0, -longSize},
+			DirRight: {0, longSize},
+		}
+
+		for direction, offset := range offsets {
+			lat := centerLat + offset[0]
+			long := centerLong + offset[1]
+
+			moved, err := partition.Translate(direction)
+			if lat < LatMin || lat > LatMax {
+				if !errors.Is(err, ErrPartitionPole) {
+					return false
+				}
+
+				continue
+			}
+
+			// Longitude wraps across the antimeridian
+			if long < LongMin {
+				long += LongMax - LongMin
+			} else if long > LongMax {
+				long -= LongMax - LongMin
+			}
+
+			want, wantErr := NewPartitionFromCoords(lat, long, depth)
+			if err != nil || wantErr != nil || moved.Encoded != want.Encoded {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	if err := quick.Check(property, partitionQuickConfig); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPartitionTranslateWraps(t *testing.T) {
+	property := func(in partitionInput) bool {
+		lat, long, depth := in.coords()
+
+		// Keep the walk around the globe short
+		depth = depth%8 + 1
+
+		partition, err := NewPartitionFromCoords(lat, long, depth)
+		if err != nil {
+			return false
+		}
+
+		moved := partition
+		for i := 0; i < 1<<depth; i++ {
+			if moved, err = moved.Translate(DirRight); err != nil {
+				return false
+			}
+		}
+
+		return moved.Encoded == partition.Encoded
+	}
+
+	if err := quick.Check(property, partitionQuickConfig); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPartitionTranslatePole(t *testing.T) {
+	for depth := uint(1); depth <= MaxPartitionDepth; depth++ {
+		south, err := NewPartitionFromCoords(LatMin, 0, depth)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := south.Translate(DirUp); !errors.Is(err, ErrPartitionPole) {
+			t.Fatalf("depth %d: got %v translating past the south pole, want %v", depth, err, ErrPartitionPole)
+		}
+
+		north, err := NewPartitionFromCoords(LatMax, 0, depth)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := north.Translate(DirDown); !errors.Is(err, ErrPartitionPole) {
+			t.Fatalf("depth %d: got %v translating past the north pole, want %v", depth, err, ErrPartitionPole)
+		}
+	}
+}
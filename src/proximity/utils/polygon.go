@@ -0,0 +1,81 @@
+package utils
+
+import "math"
+
+type Point struct {
+	Lat  float64 `json:"lat"`
+	Long float64 `json:"long"`
+}
+
+// Check if a coordinate is within the coordinate bounds
+func inBounds(lat float64, long float64) bool {
+	return lat >= LatMin && lat <= LatMax && long >= LongMin && long <= LongMax
+}
+
+// Check if a coordinate lies within a polygon using ray casting
+func InPolygon(lat float64, long float64, points []*Point) bool {
+	inside := false
+
+	for i, j := 0, len(points)-1; i < len(points); j, i = i, i+1 {
+		a := points[i]
+		b := points[j]
+
+		if (a.Lat > lat) != (b.Lat > lat) && long < (b.Long-a.Long)*(lat-a.Lat)/(b.Lat-a.Lat)+a.Long {
+			inside = !inside
+		}
+	}
+
+	return inside
+}
+
+// Calculate the bounding box of a polygon
+func PolygonBounds(points []*Point) (float64, float64, float64, float64) {
+	minLat, minLong := points[0].Lat, points[0].Long
+	maxLat, maxLong := points[0].Lat, points[0].Long
+
+	for _, point := range points[1:] {
+		if point.Lat < minLat {
+			minLat = point.Lat
+		}
+		if point.Lat > maxLat {
+			maxLat = point.Lat
+		}
+		if point.Long < minLong {
+			minLong = point.Long
+		}
+		if point.Long > maxLong {
+			maxLong = point.Long
+		}
+	}
+
+	return minLat, minLong, maxLat, maxLong
+}
+
+// Approximate the distance in meters from a coordinate to the boundary of a polygon
+func DistanceToPolygon(lat float64, long float64, points []*Point) float64 {
+	// Project onto a plane centered at the coordinate
+	metersPerDegree := toRadians(1) * EarthRadius
+	scale := math.Cos(toRadians(lat))
+
+	project := func(point *Point) (float64, float64) {
+		return (point.Long - long) * scale * metersPerDegree, (point.Lat - lat) * metersPerDegree
+	}
+
+	distance := math.Inf(1)
+
+	for i, j := 0, len(points)-1; i < len(points); j, i = i, i+1 {
+		ax, ay := project(points[i])
+		bx, by := project(points[j])
+
+		// Closest point on the segment to the origin
+		dx, dy := bx-ax, by-ay
+		t := 0.0
+		if length := dx*dx + dy*dy; length > 0 {
+			t = math.Max(0, math.Min(1, -(ax*dx+ay*dy)/length))
+		}
+
+		distance = math.Min(distance, math.Hypot(ax+t*dx, ay+t*dy))
+	}
+
+	return distance
+}
@@ -0,0 +1,280 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Area where a user is never shown to others
+type HiddenZone struct {
+	Lat    float64 `json:"lat"`
+	Long   float64 `json:"long"`
+	Radius float64 `json:"radius"`
+}
+
+type PrivacySettings struct {
+	FuzzRadius  float64       `json:"fuzzRadius"`
+	HiddenZones []*HiddenZone `json:"hiddenZones"`
+	CoarseOnly  bool          `json:"coarseOnly"`
+}
+
+type Privacy struct {
+	ctx   context.Context
+	redis *redis.Client
+}
+
+const (
+	privacyRegistryKey = "privacy:settings"
+
+	// Grid size of every user whose shown position is snapped so queries only widen as far as the largest grid in use
+	privacyGridKey = "privacy:grid"
+
+	// Bounds for privacy settings in meters
+	MaxFuzzRadius       = 5000
+	MaxHiddenZones      = 10
+	MaxHiddenZoneRadius = 5000
+
+	// Size of the grid in meters and the partition depth shown for users who only share a coarse location
+	CoarseGridSize       = 10000
+	CoarsePartitionDepth = 5
+
+	// Farthest in meters a shown position may be from the exact one for the largest grid
+	PrivacyPadding = CoarseGridSize
+
+	metersPerDegree = EarthRadius * math.Pi / 180
+)
+
+// Parse and validate privacy settings from a message body
+func NewPrivacySettings(body string) (*PrivacySettings, error) {
+	settings := &PrivacySettings{}
+
+	if body != "" {
+		if err := json.Unmarshal([]byte(body), settings); err != nil {
+			return nil, errors.New("invalid privacy settings")
+		}
+	}
+
+	if settings.FuzzRadius < 0 || settings.FuzzRadius > MaxFuzzRadius {
+		return nil, errors.New("fuzz radius out of bounds")
+	}
+
+	if len(settings.HiddenZones) > MaxHiddenZones {
+		return nil, errors.New("too many hidden zones")
+	}
+
+	for _, zone := range settings.HiddenZones {
+		if zone == nil || !inBounds(zone.Lat, zone.Long) || zone.Radius <= 0 || zone.Radius > MaxHiddenZoneRadius {
+			return nil, errors.New("invalid hidden zone")
+		}
+	}
+
+	if settings.HiddenZones == nil {
+		settings.HiddenZones = make([]*HiddenZone, 0)
+	}
+
+	return settings, nil
+}
+
+// Check if a coordinate lies inside any hidden zone
+func (p *PrivacySettings) Hidden(lat float64, long float64) bool {
+	for _, zone := range p.HiddenZones {
+		if Haversine(zone.Lat, zone.Long, lat, long) <= zone.Radius {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Size of the grid in meters which shared positions snap to or zero for exact positions
+func (p *PrivacySettings) gridSize() float64 {
+	if p.CoarseOnly {
+		return CoarseGridSize
+	}
+
+	return p.FuzzRadius
+}
+
+// Snap a coordinate to the center of its grid cell so repeated queries never reveal more than the cell
+func snap(lat float64, long float64, size float64) (float64, float64) {
+	latStep := size / metersPerDegree
+	snappedLat := math.Max(math.Min((math.Floor(lat/latStep)+0.5)*latStep, LatMax), LatMin)
+
+	// Cells keep the same width in meters away from the equator
+	longStep := latStep / math.Max(math.Cos(toRadians(snappedLat)), latStep/(LongMax-LongMin))
+	snappedLong := (math.Floor(long/longStep) + 0.5) * longStep
+	if snappedLong > LongMax {
+		snappedLong -= LongMax - LongMin
+	} else if snappedLong < LongMin {
+		snappedLong += LongMax - LongMin
+	}
+
+	return snappedLat, snappedLong
+}
+
+// Round a distance up to the grid size so it cannot be used to locate the user
+func (p *PrivacySettings) Distance(distance float64) float64 {
+	size := p.gridSize()
+	if size == 0 {
+		return distance
+	}
+
+	return math.Max(math.Ceil(distance/size), 1) * size
+}
+
+// Position shown to others for a coordinate
+func (p *PrivacySettings) Position(lat float64, long float64) (float64, float64) {
+	size := p.gridSize()
+	if size == 0 {
+		return lat, long
+	}
+
+	return snap(lat, long, size)
+}
+
+// Make the copy of a nearby user which is shown to others with the distance from a point or nil if the user is hidden
+func (p *PrivacySettings) Apply(user *NearbyUser, lat float64, long float64) (*NearbyUser, error) {
+	if p.Hidden(user.Data.Lat, user.Data.Long) {
+		return nil, nil
+	}
+
+	size := p.gridSize()
+	if size == 0 {
+		return &NearbyUser{Data: user.Data, Partition: user.Partition, Distance: Haversine(lat, long, user.Data.Lat, user.Data.Long)}, nil
+	}
+
+	shownLat, shownLong := snap(user.Data.Lat, user.Data.Long, size)
+
+	depth := uint(len(user.Partition.Encoded))
+	if p.CoarseOnly && depth > CoarsePartitionDepth {
+		depth = CoarsePartitionDepth
+	}
+
+	partition, err := NewPartitionFromCoords(shownLat, shownLong, depth)
+	if err != nil {
+		return nil, err
+	}
+
+	// Readings are dropped as the accuracy and altitude would refine the snapped position
+	return &NearbyUser{
+		Data:      &UserData{User: user.Data.User, Lat: shownLat, Long: shownLong, Timestamp: user.Data.Timestamp},
+		Partition: partition,
+		Distance:  p.Distance(Haversine(lat, long, shownLat, shownLong)),
+	}, nil
+}
+
+// Make a new privacy settings store
+func NewPrivacy(ctx context.Context, redis *redis.Client) *Privacy {
+	return &Privacy{ctx: ctx, redis: redis}
+}
+
+// Store the privacy settings of a user
+func (p *Privacy) Set(user string, settings *PrivacySettings) error {
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.redis.TxPipelined(p.ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(p.ctx, privacyRegistryKey, user, data)
+
+		if size := settings.gridSize(); size > 0 {
+			pipe.ZAdd(p.ctx, privacyGridKey, redis.Z{Score: size, Member: user})
+		} else {
+			pipe.ZRem(p.ctx, privacyGridKey, user)
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+// Farthest in meters any shown position may be from the exact one for the grids in use so queries widened by it find everyone who may be shown inside
+func (p *Privacy) Padding() (float64, error) {
+	largest, err := p.redis.ZRevRangeWithScores(p.ctx, privacyGridKey, 0, 0).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	if len(largest) == 0 {
+		return 0, nil
+	}
+
+	return math.Min(largest[0].Score, PrivacyPadding), nil
+}
+
+// Get the privacy settings of a user which default to sharing the exact location
+func (p *Privacy) Get(user string) (*PrivacySettings, error) {
+	data, err := p.redis.HGet(p.ctx, privacyRegistryKey, user).Result()
+	if err == redis.Nil {
+		return NewPrivacySettings("")
+	} else if err != nil {
+		return nil, err
+	}
+
+	return NewPrivacySettings(data)
+}
+
+// Apply the privacy settings of every user to candidates found within the area widened by the padding and keep those shown inside the area sorted by the distance shown
+func (p *Privacy) Apply(users []*NearbyUser, area *QueryArea) ([]*NearbyUser, error) {
+	if len(users) == 0 {
+		return make([]*NearbyUser, 0), nil
+	}
+
+	names := make([]string, len(users))
+	for i, user := range users {
+		names[i] = user.Data.User
+	}
+
+	values, err := p.redis.HMGet(p.ctx, privacyRegistryKey, names...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	settings := make([]*PrivacySettings, len(users))
+	for i := range users {
+		settings[i] = &PrivacySettings{}
+
+		if data, ok := values[i].(string); ok {
+			// Users with unreadable settings are hidden rather than shown exactly
+			if settings[i], err = NewPrivacySettings(data); err != nil {
+				settings[i] = nil
+			}
+		}
+	}
+
+	return ShowUsers(users, settings, area)
+}
+
+// Show each user with their settings and keep those shown inside the area sorted by the distance shown where users without settings are hidden
+func ShowUsers(users []*NearbyUser, settings []*PrivacySettings, area *QueryArea) ([]*NearbyUser, error) {
+	out := make([]*NearbyUser, 0, len(users))
+
+	for i, user := range users {
+		if settings[i] == nil {
+			continue
+		}
+
+		shown, err := settings[i].Apply(user, area.Lat, area.Long)
+		if err != nil {
+			return nil, err
+		}
+
+		// Users are matched where they are shown so the area never reveals more than the shown position
+		if shown != nil && area.Contains(shown.Data.Lat, shown.Data.Long) {
+			out = append(out, shown)
+		}
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Distance < out[j].Distance
+	})
+
+	return out, nil
+}
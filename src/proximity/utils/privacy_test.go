@@ -0,0 +1,204 @@
+package utils
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// Make a nearby user at a coordinate with readings measured from a point
+func privacyUser(user string, lat float64, long float64, fromLat float64, fromLong float64) *NearbyUser {
+	accuracy := 5.0
+	partition, _ := NewPartitionFromCoords(lat, long, MaxPartitionDepth)
+
+	return &NearbyUser{
+		Data:      &UserData{User: user, Lat: lat, Long: long, Reading: Reading{Accuracy: &accuracy}},
+		Partition: partition,
+		Distance:  Haversine(fromLat, fromLong, lat, long),
+	}
+}
+
+func TestPrivacySettingsNeverShowExact(t *testing.T) {
+	rng := rand.New(rand.NewSource(6))
+
+	for _, settings := range []*PrivacySettings{{FuzzRadius: 250}, {FuzzRadius: MaxFuzzRadius}, {CoarseOnly: true}} {
+		size := settings.gridSize()
+
+		for i := 0; i < 1000; i++ {
+			lat := -80 + rng.Float64()*160
+			long := LongMin + rng.Float64()*(LongMax-LongMin)
+			fromLat, fromLong := lat+rng.Float64()*0.1, long
+
+			user := privacyUser("a", lat, long, fromLat, fromLong)
+
+			shown, err := settings.Apply(user, fromLat, fromLong)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if shown.Data.Lat == lat || shown.Data.Long == long || shown.Data.Reading != (Reading{}) {
+				t.Fatalf("got %+v shown for a user at %f, %f", shown.Data, lat, long)
+			}
+
+			if Haversine(lat, long, shown.Data.Lat, shown.Data.Long) > PrivacyPadding {
+				t.Fatalf("got a position shown %f meters away which is past the padding", Haversine(lat, long, shown.Data.Lat, shown.Data.Long))
+			}
+
+			// The partition is derived from the shown position
+			partition, err := NewPartitionFromCoords(shown.Data.Lat, shown.Data.Long, uint(len(shown.Partition.Encoded)))
+			if err != nil || partition.Encoded != shown.Partition.Encoded {
+				t.Fatalf("got partition %s which is not the partition of the shown position", shown.Partition.Encoded)
+			}
+
+			// The distance is measured from the shown position and rounded up to the grid
+			want := settings.Distance(Haversine(fromLat, fromLong, shown.Data.Lat, shown.Data.Long))
+			if shown.Distance != want || int(shown.Distance)%int(size) != 0 {
+				t.Fatalf("got distance %f, want %f", shown.Distance, want)
+			}
+		}
+	}
+}
+
+func TestPrivacyShowInsideArea(t *testing.T) {
+	fromLat, fromLong := 37.7749, -122.4194
+	radius := 5000.0
+	area := NewRadiusArea(fromLat, fromLong, radius)
+
+	coarse := &PrivacySettings{CoarseOnly: true}
+	exact := &PrivacySettings{}
+	hidden := &PrivacySettings{HiddenZones: []*HiddenZone{{Lat: 37.80, Long: -122.42, Radius: 1000}}}
+
+	rng := rand.New(rand.NewSource(7))
+
+	users := make([]*NearbyUser, 0)
+	settings := make([]*PrivacySettings, 0)
+
+	// Candidates are spread over the radius widened by the padding as the stores would return them
+	for i := 0; i < 2000; i++ {
+		lat, long := randomWithin(rng, fromLat, fromLong, radius+PrivacyPadding)
+
+		users = append(users, privacyUser(strconv.Itoa(i), lat, long, fromLat, fromLong))
+		settings = append(settings, []*PrivacySettings{coarse, exact, hidden, nil}[i%4])
+	}
+
+	out, err := ShowUsers(users, settings, area)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	byUser := make(map[string]int)
+	for i, user := range users {
+		byUser[user.Data.User] = i
+	}
+
+	matched := make(map[string]bool)
+	for i, shown := range out {
+		matched[shown.Data.User] = true
+
+		index := byUser[shown.Data.User]
+		user, setting := users[index], settings[index]
+
+		if setting == nil {
+			t.Fatalf("got user %s without readable settings", shown.Data.User)
+		}
+
+		// Only users who share their exact position are shown at it
+		if setting.gridSize() > 0 && shown.Data.Lat == user.Data.Lat && shown.Data.Long == user.Data.Long {
+			t.Fatalf("got the exact position of user %s", shown.Data.User)
+		}
+
+		if setting.Hidden(user.Data.Lat, user.Data.Long) {
+			t.Fatalf("got user %s from inside a hidden zone", shown.Data.User)
+		}
+
+		// Matching uses the shown position and the distance is measured from it
+		if !area.Contains(shown.Data.Lat, shown.Data.Long) {
+			t.Fatalf("got user %s shown outside the area", shown.Data.User)
+		}
+
+		if want := setting.Distance(Haversine(fromLat, fromLong, shown.Data.Lat, shown.Data.Long)); shown.Distance != want {
+			t.Fatalf("got distance %f for user %s, want %f", shown.Distance, shown.Data.User, want)
+		}
+
+		if i > 0 && out[i-1].Distance > shown.Distance {
+			t.Fatal("got users out of order")
+		}
+	}
+
+	// Every user shown inside the area is matched even when their exact position is outside it
+	for i, user := range users {
+		if settings[i] == nil || settings[i].Hidden(user.Data.Lat, user.Data.Long) {
+			continue
+		}
+
+		lat, long := settings[i].Position(user.Data.Lat, user.Data.Long)
+		if area.Contains(lat, long) != matched[user.Data.User] {
+			t.Fatalf("got user %s matched %t where they are shown at %f meters", user.Data.User, matched[user.Data.User], Haversine(fromLat, fromLong, lat, long))
+		}
+	}
+}
+
+func TestPrivacyPadding(t *testing.T) {
+	client := testRedis(t)
+	privacy := NewPrivacy(context.Background(), client)
+
+	user := uuid.NewString()
+	t.Cleanup(func() {
+		client.HDel(context.Background(), privacyRegistryKey, user)
+		client.ZRem(context.Background(), privacyGridKey, user)
+	})
+
+	// The padding follows the largest grid in use
+	for _, settings := range []*PrivacySettings{{CoarseOnly: true}, {FuzzRadius: 50}, {}} {
+		if err := privacy.Set(user, settings); err != nil {
+			t.Fatal(err)
+		}
+
+		score, err := client.ZScore(context.Background(), privacyGridKey, user).Result()
+		if settings.gridSize() == 0 {
+			if err == nil {
+				t.Fatal("got a grid recorded for a user sharing their exact location")
+			}
+
+			continue
+		}
+
+		if err != nil || score != settings.gridSize() {
+			t.Fatalf("got grid %f recorded, want %f", score, settings.gridSize())
+		}
+
+		padding, err := privacy.Padding()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if padding < settings.gridSize() || padding > PrivacyPadding {
+			t.Fatalf("got padding %f for a grid of %f", padding, settings.gridSize())
+		}
+	}
+}
+
+// Pick a random coordinate within a radius in meters of a point
+func randomWithin(rng *rand.Rand, lat float64, long float64, radius float64) (float64, float64) {
+	for {
+		minLat, minLong, maxLat, maxLong := BoundingBox(lat, long, radius)
+
+		// Boxes crossing the antimeridian are sampled past it then wrapped back
+		if minLong > maxLong {
+			maxLong += LongMax - LongMin
+		}
+
+		otherLat := minLat + rng.Float64()*(maxLat-minLat)
+		otherLong := minLong + rng.Float64()*(maxLong-minLong)
+		if otherLong > LongMax {
+			otherLong -= LongMax - LongMin
+		}
+
+		if Haversine(lat, long, otherLat, otherLong) <= radius {
+			return otherLat, otherLong
+		}
+	}
+}
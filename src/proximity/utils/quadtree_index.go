@@ -0,0 +1,174 @@
+package utils
+
+import (
+	"errors"
+	"math"
+	"sync"
+)
+
+const (
+	// Difference in depth between consecutive resolution levels
+	partitionLevelStep = 2
+
+	// Largest number of cells a query may scan before a coarser level is preferred
+	maxQueryCells = 64
+
+	// Radius queries prefer the finest level where the circle spans at most three cells along each axis
+	maxRadiusCells = 9
+)
+
+// Users indexed at a single partition depth
+type quadtreeLevel struct {
+	*cellIndex
+	depth uint
+}
+
+// Spatial index over the quadtree partitions at one or more resolutions where every level is updated together
+type QuadtreeIndex struct {
+	mutex  sync.RWMutex
+	levels []*quadtreeLevel
+}
+
+// Create a new quadtree index at a depth with a number of coarser resolution levels
+func NewQuadtreeIndex(depth uint, levels int) (*QuadtreeIndex, error) {
+	if depth < 1 || depth > MaxPartitionDepth {
+		return nil, errors.New("partition depth out of bounds")
+	}
+
+	if levels < 1 || (levels-1)*partitionLevelStep >= int(depth) {
+		return nil, errors.New("partition levels out of bounds")
+	}
+
+	// Levels are ordered from finest to coarsest
+	index := &QuadtreeIndex{levels: make([]*quadtreeLevel, levels)}
+
+	for i := range index.levels {
+		levelDepth := depth - uint(i*partitionLevelStep)
+		latSize, longSize := PartitionSize(levelDepth)
+
+		index.levels[i] = &quadtreeLevel{depth: levelDepth, cellIndex: newCellIndex(func(lat float64, long float64) (string, error) {
+			partition, err := NewPartitionFromCoords(lat, long, levelDepth)
+			if err != nil {
+				return "", err
+			}
+
+			return partition.Encoded, nil
+		}, latSize, longSize)}
+	}
+
+	return index, nil
+}
+
+// Insert a new user at every level
+func (q *QuadtreeIndex) Insert(user string, lat float64, long float64) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for _, level := range q.levels {
+		if err := level.Insert(user, lat, long); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Move an existing user at every level
+func (q *QuadtreeIndex) Move(user string, lat float64, long float64) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for _, level := range q.levels {
+		if err := level.Move(user, lat, long); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Remove a user from every level
+func (q *QuadtreeIndex) Remove(user string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for _, level := range q.levels {
+		level.Remove(user)
+	}
+}
+
+// Find the finest level which scans at most a number of cells for a bounding box
+func (q *QuadtreeIndex) boxLevel(maxCells float64, minLat float64, minLong float64, maxLat float64, maxLong float64) *quadtreeLevel {
+	for _, level := range q.levels {
+		if level.boxCount(minLat, minLong, maxLat, maxLong) <= maxCells {
+			return level
+		}
+	}
+
+	return q.levels[len(q.levels)-1]
+}
+
+// Find the cells around a coordinate covering a radius in meters as the rectangle of neighbors of its cell which widens toward the poles
+func (l *quadtreeLevel) radiusCells(lat float64, long float64, radius float64) ([]string, error) {
+	partition, err := NewPartitionFromCoords(lat, long, l.depth)
+	if err != nil {
+		return nil, err
+	}
+
+	cell, err := NewCellFromPartition(partition)
+	if err != nil {
+		return nil, err
+	}
+
+	// The bounding box is centered on the coordinate unless it covers every longitude
+	minLat, minLong, maxLat, maxLong := BoundingBox(lat, long, radius)
+
+	spanLong := maxLong - minLong
+	if spanLong < 0 {
+		spanLong += LongMax - LongMin
+	}
+
+	rows := int(math.Ceil(math.Max(maxLat-lat, lat-minLat) / l.latSize))
+	cols := int(math.Ceil(spanLong / 2 / l.longSize))
+
+	cells := cell.Nearby(rows, cols)
+	out := make([]string, len(cells))
+
+	for i, cell := range cells {
+		out[i] = cell.Encoded()
+	}
+
+	return out, nil
+}
+
+// Find all users within a radius in meters by searching the neighbors of the cell of the coordinate
+func (q *QuadtreeIndex) QueryRadius(lat float64, long float64, radius float64) ([]string, error) {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+
+	minLat, minLong, maxLat, maxLong := BoundingBox(lat, long, radius)
+	level := q.boxLevel(maxRadiusCells, minLat, minLong, maxLat, maxLong)
+
+	filter := func(entry *indexEntry) bool {
+		return Haversine(lat, long, entry.lat, entry.long) <= radius
+	}
+
+	if level.sparse(minLat, minLong, maxLat, maxLong) {
+		return level.queryAll(filter), nil
+	}
+
+	cells, err := level.radiusCells(lat, long, radius)
+	if err != nil {
+		return nil, err
+	}
+
+	return level.query(cells, filter), nil
+}
+
+// Find all users within a bounding box using the finest level which scans a bounded number of cells
+func (q *QuadtreeIndex) QueryBox(minLat float64, minLong float64, maxLat float64, maxLong float64) ([]string, error) {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+
+	return q.boxLevel(maxQueryCells, minLat, minLong, maxLat, maxLong).QueryBox(minLat, minLong, maxLat, maxLong)
+}
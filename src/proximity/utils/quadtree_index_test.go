@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+type testPoint struct {
+	user string
+	lat  float64
+	long float64
+}
+
+// Generate random points within a latitude band
+func randomPoints(rng *rand.Rand, count int, minLat float64, maxLat float64) []*testPoint {
+	points := make([]*testPoint, count)
+	for i := range points {
+		points[i] = &testPoint{
+			user: strconv.Itoa(i),
+			lat:  minLat + rng.Float64()*(maxLat-minLat),
+			long: LongMin + rng.Float64()*(LongMax-LongMin),
+		}
+	}
+
+	return points
+}
+
+// Find the users within a radius by checking every point
+func bruteForceRadius(points []*testPoint, lat float64, long float64, radius float64) []string {
+	users := make([]string, 0)
+	for _, point := range points {
+		if Haversine(lat, long, point.lat, point.long) <= radius {
+			users = append(users, point.user)
+		}
+	}
+
+	return sortedUsers(users)
+}
+
+// Sort a list of users
+func sortedUsers(users []string) []string {
+	sort.Strings(users)
+
+	return users
+}
+
+// Check that two sorted lists of users are equal
+func sameUsers(t *testing.T, got []string, want []string) {
+	t.Helper()
+
+	sortedUsers(got)
+
+	if len(got) != len(want) {
+		t.Fatalf("got %d users, want %d", len(got), len(want))
+	}
+
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("got user %s, want %s", got[i], want[i])
+		}
+	}
+}
+
+func TestQuadtreeIndexQueryRadiusNearPoles(t *testing.T) {
+	configs := []struct {
+		depth  uint
+		levels int
+	}{
+		{10, 1},
+		{14, 3},
+	}
+
+	for _, config := range configs {
+		rng := rand.New(rand.NewSource(1))
+
+		index, err := NewQuadtreeIndex(config.depth, config.levels)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		points := append(randomPoints(rng, 1500, 88, 90), randomPoints(rng, 1500, -90, -88)...)
+		for i, point := range points {
+			point.user = strconv.Itoa(i)
+			if err := index.Insert(point.user, point.lat, point.long); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, query := range randomPoints(rng, 50, 88.5, 89.5) {
+			for _, lat := range []float64{query.lat, -query.lat} {
+				users, err := index.QueryRadius(lat, query.long, 50000)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				sameUsers(t, users, bruteForceRadius(points, lat, query.long, 50000))
+			}
+		}
+	}
+}
+
+func TestQuadtreeRadiusCellsCoverRadius(t *testing.T) {
+	rng := rand.New(rand.NewSource(8))
+
+	index, err := NewQuadtreeIndex(10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	level := index.levels[0]
+
+	// Points near the poles and the antimeridian widen the neighbors the most
+	queries := append(randomPoints(rng, 100, -89.9, 89.9), randomPoints(rng, 20, 85, 89.99)...)
+	queries = append(queries, &testPoint{lat: 10, long: 179.99}, &testPoint{lat: -10, long: -179.99})
+
+	for _, query := range queries {
+		for _, radius := range []float64{100, 5000, 50000} {
+			cells, err := level.radiusCells(query.lat, query.long, radius)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			found := make(map[string]bool)
+			for _, cell := range cells {
+				found[cell] = true
+			}
+
+			// Every point inside the radius lies in one of the cells
+			for i := 0; i < 50; i++ {
+				lat, long := randomWithin(rng, query.lat, query.long, radius)
+
+				partition, err := NewPartitionFromCoords(lat, long, level.depth)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !found[partition.Encoded] {
+					t.Fatalf("cell of %f, %f within %f meters of %f, %f is not searched", lat, long, radius, query.lat, query.long)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package utils
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Pagination, freshness and group options shared by all area queries
+type PageQuery struct {
+	Limit      int    `json:"limit"`
+	Cursor     string `json:"cursor"`
+	SeenWithin int    `json:"seenWithin"`
+	Group      string `json:"group"`
+	offset     int
+}
+
+type NearbyQuery struct {
+	Radius float64 `json:"radius"`
+	PageQuery
+}
+
+type BoxQuery struct {
+	MinLat  float64 `json:"minLat"`
+	MinLong float64 `json:"minLong"`
+	MaxLat  float64 `json:"maxLat"`
+	MaxLong float64 `json:"maxLong"`
+	PageQuery
+}
+
+type PolygonQuery struct {
+	Points []*Point `json:"points"`
+	PageQuery
+}
+
+// Area matched by a query against the positions shown to the viewer with the point distances are measured from
+type QueryArea struct {
+	Lat      float64
+	Long     float64
+	contains func(lat float64, long float64) bool
+}
+
+// Bounds for area queries where radius is in meters and seen within is in seconds
+const (
+	DefaultNearbyRadius = 5000
+	MaxNearbyRadius     = 50000
+	DefaultNearbyLimit  = 50
+	MaxNearbyLimit      = 200
+	MaxNearbySeenWithin = 24 * 60 * 60
+	MaxPolygonPoints    = 100
+
+	// Widest box or polygon in meters which matches the widest nearby query
+	MaxAreaSpan = 2 * MaxNearbyRadius
+
+	// Most candidates checked for visibility and privacy while filling a single page
+	MaxPageScan = 1000
+)
+
+// Parse a query from a message body
+func parseQuery(body string, query interface{}) error {
+	if body == "" {
+		return nil
+	}
+
+	if err := json.Unmarshal([]byte(body), query); err != nil {
+		return errors.New("invalid query")
+	}
+
+	return nil
+}
+
+// Apply defaults and validate the page options
+func (q *PageQuery) validate() error {
+	if q.Limit == 0 {
+		q.Limit = DefaultNearbyLimit
+	}
+
+	if q.Limit < 0 || q.Limit > MaxNearbyLimit {
+		return errors.New("limit out of bounds")
+	}
+
+	if q.SeenWithin < 0 || q.SeenWithin > MaxNearbySeenWithin {
+		return errors.New("seen within out of bounds")
+	}
+
+	if !validGroup(q.Group) {
+		return errors.New("invalid group")
+	}
+
+	if q.Cursor != "" {
+		offset, err := decodeCursor(q.Cursor)
+		if err != nil {
+			return errors.New("invalid cursor")
+		}
+
+		q.offset = offset
+	}
+
+	return nil
+}
+
+// Parse and validate a nearby query from a message body
+func NewNearbyQuery(body string) (*NearbyQuery, error) {
+	query := &NearbyQuery{}
+	if err := parseQuery(body, query); err != nil {
+		return nil, err
+	}
+
+	if query.Radius == 0 {
+		query.Radius = DefaultNearbyRadius
+	}
+
+	if query.Radius < 0 || query.Radius > MaxNearbyRadius {
+		return nil, errors.New("radius out of bounds")
+	}
+
+	if err := query.validate(); err != nil {
+		return nil, err
+	}
+
+	return query, nil
+}
+
+// Parse and validate a bounding box query from a message body where the minimum longitude exceeds the maximum when crossing the antimeridian
+func NewBoxQuery(body string) (*BoxQuery, error) {
+	query := &BoxQuery{}
+	if err := parseQuery(body, query); err != nil {
+		return nil, err
+	}
+
+	if !inBounds(query.MinLat, query.MinLong) || !inBounds(query.MaxLat, query.MaxLong) || query.MinLat > query.MaxLat {
+		return nil, errors.New("invalid bounding box")
+	}
+
+	if areaSpan(query.MinLat, query.MinLong, query.MaxLat, query.MaxLong) > MaxAreaSpan {
+		return nil, errors.New("bounding box too large")
+	}
+
+	if err := query.validate(); err != nil {
+		return nil, err
+	}
+
+	return query, nil
+}
+
+// Parse and validate a polygon query from a message body
+func NewPolygonQuery(body string) (*PolygonQuery, error) {
+	query := &PolygonQuery{}
+	if err := parseQuery(body, query); err != nil {
+		return nil, err
+	}
+
+	if len(query.Points) < 3 || len(query.Points) > MaxPolygonPoints {
+		return nil, errors.New("invalid polygon")
+	}
+
+	for _, point := range query.Points {
+		if point == nil || !inBounds(point.Lat, point.Long) {
+			return nil, errors.New("invalid polygon")
+		}
+	}
+
+	if areaSpan(PolygonBounds(query.Points)) > MaxAreaSpan {
+		return nil, errors.New("polygon too large")
+	}
+
+	if err := query.validate(); err != nil {
+		return nil, err
+	}
+
+	return query, nil
+}
+
+// Make the area within a radius in meters of a point
+func NewRadiusArea(lat float64, long float64, radius float64) *QueryArea {
+	return &QueryArea{Lat: lat, Long: long, contains: func(otherLat float64, otherLong float64) bool {
+		return Haversine(lat, long, otherLat, otherLong) <= radius
+	}}
+}
+
+// Make the area inside a bounding box measured from its center
+func NewBoxArea(minLat float64, minLong float64, maxLat float64, maxLong float64) *QueryArea {
+	lat, long := BoxCenter(minLat, minLong, maxLat, maxLong)
+
+	return &QueryArea{Lat: lat, Long: long, contains: func(otherLat float64, otherLong float64) bool {
+		return InBox(otherLat, otherLong, minLat, minLong, maxLat, maxLong)
+	}}
+}
+
+// Make the area inside a polygon measured from the center of its bounds
+func NewPolygonArea(points []*Point) *QueryArea {
+	minLat, minLong, maxLat, maxLong := PolygonBounds(points)
+
+	return &QueryArea{Lat: (minLat + maxLat) / 2, Long: (minLong + maxLong) / 2, contains: func(lat float64, long float64) bool {
+		return InPolygon(lat, long, points)
+	}}
+}
+
+// Check if a shown position is inside the area
+func (a *QueryArea) Contains(lat float64, long float64) bool {
+	return a.contains(lat, long)
+}
+
+// Largest side in meters of a bounding box where the width is measured at the latitude nearest the equator
+func areaSpan(minLat float64, minLong float64, maxLat float64, maxLong float64) float64 {
+	longSpan := maxLong - minLong
+	if longSpan < 0 {
+		longSpan += LongMax - LongMin
+	}
+
+	widest := 0.0
+	if minLat > 0 {
+		widest = minLat
+	} else if maxLat < 0 {
+		widest = maxLat
+	}
+
+	height := (maxLat - minLat) * metersPerDegree
+	width := longSpan * metersPerDegree * math.Cos(toRadians(widest))
+
+	return math.Max(height, width)
+}
+
+// Encode an offset as an opaque cursor
+func encodeCursor(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(offset)))
+}
+
+// Decode an opaque cursor to an offset
+func decodeCursor(cursor string) (int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+
+	offset, err := strconv.Atoi(string(data))
+	if err != nil {
+		return 0, err
+	}
+
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+
+	return offset, nil
+}
+
+// Freshness window for the query or zero if unset
+func (q *PageQuery) Freshness() time.Duration {
+	return time.Duration(q.SeenWithin) * time.Second
+}
+
+// Select the page of candidates kept by a filter and return the cursor for the next page where the filter only sees as many candidates as could still fit
+func (q *PageQuery) Page(users []*NearbyUser, filter func([]*NearbyUser) ([]*NearbyUser, error)) ([]*NearbyUser, string, error) {
+	page := make([]*NearbyUser, 0, q.Limit)
+
+	// Candidates are scanned a bounded number at a time so sparse pages cannot look up every candidate
+	start := q.offset
+	scanned := 0
+	for start < len(users) && len(page) < q.Limit && scanned < MaxPageScan {
+		end := start + q.Limit - len(page)
+		if end > len(users) {
+			end = len(users)
+		}
+
+		kept, err := filter(users[start:end])
+		if err != nil {
+			return nil, "", err
+		}
+
+		page = append(page, kept...)
+		scanned += end - start
+		start = end
+	}
+
+	sort.SliceStable(page, func(i, j int) bool {
+		return page[i].Distance < page[j].Distance
+	})
+
+	if start >= len(users) {
+		return page, "", nil
+	}
+
+	return page, encodeCursor(start), nil
+}
@@ -0,0 +1,136 @@
+package utils
+
+import (
+	"strconv"
+	"testing"
+)
+
+// Make nearby users sorted by distance
+func pageUsers(count int) []*NearbyUser {
+	users := make([]*NearbyUser, count)
+	for i := range users {
+		users[i] = &NearbyUser{Data: &UserData{User: strconv.Itoa(i)}, Distance: float64(i)}
+	}
+
+	return users
+}
+
+func TestPageQueryOnlyFiltersPage(t *testing.T) {
+	query, err := NewNearbyQuery(`{"limit": 10}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := pageUsers(5000)
+
+	// Every other user is hidden
+	filtered := 0
+	filter := func(candidates []*NearbyUser) ([]*NearbyUser, error) {
+		filtered += len(candidates)
+
+		out := make([]*NearbyUser, 0)
+		for _, user := range candidates {
+			if int(user.Distance)%2 == 0 {
+				out = append(out, user)
+			}
+		}
+
+		return out, nil
+	}
+
+	seen := 0
+	for cursor := ""; ; {
+		query.Cursor = cursor
+		if err := query.validate(); err != nil {
+			t.Fatal(err)
+		}
+
+		filtered = 0
+
+		page, next, err := query.Page(users, filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(page) > query.Limit {
+			t.Fatalf("got %d users, want at most %d", len(page), query.Limit)
+		}
+
+		if filtered > 2*query.Limit {
+			t.Fatalf("filtered %d candidates for a page of %d", filtered, query.Limit)
+		}
+
+		for _, user := range page {
+			if int(user.Distance) != 2*seen {
+				t.Fatalf("got user %s, want %d", user.Data.User, 2*seen)
+			}
+
+			seen++
+		}
+
+		if next == "" {
+			break
+		}
+
+		cursor = next
+	}
+
+	if seen != len(users)/2 {
+		t.Fatalf("got %d users, want %d", seen, len(users)/2)
+	}
+}
+
+func TestPageQueryScanLimit(t *testing.T) {
+	query, err := NewNearbyQuery(`{"limit": 10}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every user is hidden
+	filtered := 0
+	page, cursor, err := query.Page(pageUsers(5000), func(candidates []*NearbyUser) ([]*NearbyUser, error) {
+		filtered += len(candidates)
+
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(page) != 0 || cursor == "" {
+		t.Fatalf("got %d users and cursor %q, want an empty page with a cursor", len(page), cursor)
+	}
+
+	if filtered != MaxPageScan {
+		t.Fatalf("filtered %d candidates, want %d", filtered, MaxPageScan)
+	}
+}
+
+func TestAreaQuerySpan(t *testing.T) {
+	tests := []struct {
+		body string
+		ok   bool
+	}{
+		{`{"minLat": 37.7, "minLong": -122.5, "maxLat": 37.8, "maxLong": -122.3}`, true},
+		{`{"minLat": 37, "minLong": -122.5, "maxLat": 38, "maxLong": -122.3}`, false},
+		{`{"minLat": 37.7, "minLong": -123.5, "maxLat": 37.8, "maxLong": -122.3}`, false},
+		{`{"minLat": 0, "minLong": 179.8, "maxLat": 0.1, "maxLong": -179.8}`, true},
+		{`{"minLat": 0, "minLong": -179.8, "maxLat": 0.1, "maxLong": 179.8}`, false},
+		{`{"minLat": 89.9, "minLong": -180, "maxLat": 90, "maxLong": 180}`, true},
+		{`{"minLat": 89.5, "minLong": -180, "maxLat": 90, "maxLong": 180}`, false},
+	}
+
+	for _, test := range tests {
+		if _, err := NewBoxQuery(test.body); (err == nil) != test.ok {
+			t.Fatalf("box %s: got %v, want ok %t", test.body, err, test.ok)
+		}
+	}
+
+	if _, err := NewPolygonQuery(`{"points": [{"lat": 37.7, "long": -122.5}, {"lat": 37.8, "long": -122.5}, {"lat": 37.8, "long": -122.4}]}`); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewPolygonQuery(`{"points": [{"lat": 30, "long": -122.5}, {"lat": 40, "long": -122.5}, {"lat": 40, "long": -110}]}`); err == nil {
+		t.Fatal("got no error for a polygon wider than the maximum span")
+	}
+}
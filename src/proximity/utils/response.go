@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	NearbyResponseVersion = 1
+	coarsePrecision       = 2
+
+	// Deepest partition reported to clients which is about as coarse as the rounded coordinates
+	MaxResponsePartitionDepth = 14
+)
+
+type NearbyResponseUser struct {
+	User      string    `json:"user"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Partition string    `json:"partition"`
+	Lat       float64   `json:"lat"`
+	Long      float64   `json:"long"`
+	Distance  float64   `json:"distance"`
+	Reading
+}
+
+type NearbyResponse struct {
+	Version int                   `json:"version"`
+	Users   []*NearbyResponseUser `json:"users"`
+	Cursor  string                `json:"cursor,omitempty"`
+}
+
+// Round a coordinate to a coarse precision
+func coarsen(value float64) float64 {
+	scale := math.Pow(10, coarsePrecision)
+
+	return math.Round(value*scale) / scale
+}
+
+// Truncate an encoded partition to the depth reported to clients where a prefix is the parent partition
+func coarsePartition(encoded string) string {
+	if len(encoded) > MaxResponsePartitionDepth {
+		return encoded[:MaxResponsePartitionDepth]
+	}
+
+	return encoded
+}
+
+// Create a new nearby response from a page of nearby users and the cursor for the next page
+func NewNearbyResponse(users []*NearbyUser, cursor string) *NearbyResponse {
+	out := make([]*NearbyResponseUser, len(users))
+
+	for i, user := range users {
+		out[i] = &NearbyResponseUser{
+			User:      user.Data.User,
+			LastSeen:  user.Data.Timestamp,
+			Partition: coarsePartition(user.Partition.Encoded),
+			Lat:       coarsen(user.Data.Lat),
+			Long:      coarsen(user.Data.Long),
+			Distance:  math.Round(user.Distance),
+			Reading:   user.Data.Reading,
+		}
+	}
+
+	return &NearbyResponse{Version: NearbyResponseVersion, Users: out, Cursor: cursor}
+}
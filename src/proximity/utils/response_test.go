@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNearbyResponsePartitionDepth(t *testing.T) {
+	partition, err := NewPartitionFromCoords(37.7749, -122.4194, MaxPartitionDepth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response := NewNearbyResponse([]*NearbyUser{{Data: &UserData{User: "a", Lat: 37.7749, Long: -122.4194}, Partition: partition}}, "")
+
+	got := response.Users[0].Partition
+	if len(got) != MaxResponsePartitionDepth {
+		t.Fatalf("got partition depth %d, want %d", len(got), MaxResponsePartitionDepth)
+	}
+
+	// The reported partition is the parent of the stored one
+	if !strings.HasPrefix(partition.Encoded, got) {
+		t.Fatalf("got partition %s which does not contain %s", got, partition.Encoded)
+	}
+
+	coarse, err := NewPartitionFromCoords(37.7749, -122.4194, MaxResponsePartitionDepth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != coarse.Encoded {
+		t.Fatalf("got partition %s, want %s", got, coarse.Encoded)
+	}
+}
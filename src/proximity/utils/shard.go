@@ -0,0 +1,409 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bengosborn/cue/helpers"
+	"github.com/bengosborn/cue/utils"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// Area query sent to the shards which own part of the area
+type ShardQuery struct {
+	Id        string        `json:"id"`
+	ReplyTo   string        `json:"replyTo"`
+	Kind      string        `json:"kind"`
+	User      string        `json:"user"`
+	Lat       float64       `json:"lat,omitempty"`
+	Long      float64       `json:"long,omitempty"`
+	Radius    float64       `json:"radius,omitempty"`
+	MinLat    float64       `json:"minLat,omitempty"`
+	MinLong   float64       `json:"minLong,omitempty"`
+	MaxLat    float64       `json:"maxLat,omitempty"`
+	MaxLong   float64       `json:"maxLong,omitempty"`
+	Points    []*Point      `json:"points,omitempty"`
+	Freshness time.Duration `json:"freshness"`
+}
+
+// Users found by a single shard for a query
+type ShardResult struct {
+	Id    string        `json:"id"`
+	Users []*NearbyUser `json:"users"`
+	Error string        `json:"error,omitempty"`
+}
+
+// Location which only holds the users inside the top level partitions owned by its shard
+type ShardedLocation struct {
+	*Location
+	ctx       context.Context
+	redis     *redis.Client
+	shard     int
+	count     int
+	ownerKey  string
+	serviceId string
+	brokers   []utils.Broker
+	reply     utils.Broker
+	replyTo   string
+	pending   sync.Map
+}
+
+const (
+	ShardKindRadius  = "radius"
+	ShardKindBox     = "box"
+	ShardKindPolygon = "polygon"
+
+	// Depth of the top level partitions which are assigned to shards
+	ShardPrefixDepth = 3
+	MaxShards        = 1 << (2 * ShardPrefixDepth)
+
+	shardOwnerPrefix = "shard:owner"
+	shardTimeout     = 2 * time.Second
+)
+
+// Make a new sharded location which owns the top level partitions assigned to the shard out of the shard count
+func NewShardedLocation(ctx context.Context, location *Location, redis *redis.Client, channel string, shard int, count int, serviceId string) (*ShardedLocation, error) {
+	if count < 1 || count > MaxShards {
+		return nil, errors.New("shard count out of bounds")
+	}
+
+	if shard < 0 || shard >= count {
+		return nil, errors.New("shard out of bounds")
+	}
+
+	brokers := make([]utils.Broker, count)
+	for i := range brokers {
+		brokers[i] = utils.NewBrokerRedis(ctx, redis, ShardChannel(channel, i), serviceId)
+	}
+
+	// Results are sent to the instance which asked as replicas of a shard share its channel
+	replyTo := helpers.FormatKey(channel, "node", location.node)
+
+	sharded := &ShardedLocation{
+		Location:  location,
+		ctx:       ctx,
+		redis:     redis,
+		shard:     shard,
+		count:     count,
+		ownerKey:  helpers.FormatKey(shardOwnerPrefix, serviceId),
+		serviceId: serviceId,
+		brokers:   brokers,
+		reply:     utils.NewBrokerRedis(ctx, redis, replyTo, serviceId),
+		replyTo:   replyTo,
+	}
+
+	return sharded, nil
+}
+
+// Channel for the messages owned by a shard
+func ShardChannel(channel string, shard int) string {
+	return helpers.FormatKey(channel, "shard", strconv.Itoa(shard))
+}
+
+// Broker for the messages owned by this shard
+func (s *ShardedLocation) ShardBroker() utils.Broker {
+	return s.brokers[s.shard]
+}
+
+// Broker for the results of queries sent by this instance
+func (s *ShardedLocation) ReplyBroker() utils.Broker {
+	return s.reply
+}
+
+// Shard which owns the top level partition of a coordinate
+func (s *ShardedLocation) Owner(lat float64, long float64) (int, error) {
+	partition, err := NewPartitionFromCoords(lat, long, ShardPrefixDepth)
+	if err != nil {
+		return 0, err
+	}
+
+	prefix, err := strconv.ParseInt(partition.Encoded, 4, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(prefix) % s.count, nil
+}
+
+// Shard which last stored the location of a user
+func (s *ShardedLocation) OwnerOf(user string) (int, error) {
+	shard, err := s.redis.HGet(s.ctx, s.ownerKey, user).Int()
+	if err == redis.Nil {
+		return 0, errors.New("user does not exist")
+	}
+
+	return shard, err
+}
+
+// Check if a shard is this shard
+func (s *ShardedLocation) Owns(shard int) bool {
+	return shard == s.shard
+}
+
+// Forward a message to the shard which owns it
+func (s *ShardedLocation) Forward(shard int, msg *utils.BrokerMessage) error {
+	return s.brokers[shard].Send(&utils.BrokerMessage{Id: uuid.NewString(), Receiver: msg.Receiver, User: msg.User, EventType: msg.EventType, Body: msg.Body})
+}
+
+// Record this shard as the owner of an upserted user and release the user from the previous owner
+func (s *ShardedLocation) Claim(userData *UserData) error {
+	previous, err := s.redis.HGet(s.ctx, s.ownerKey, userData.User).Int()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	if err := s.redis.HSet(s.ctx, s.ownerKey, userData.User, s.shard).Err(); err != nil {
+		return err
+	}
+
+	if err == redis.Nil || previous == s.shard || previous < 0 || previous >= s.count {
+		return nil
+	}
+
+	// The release happens at the time of the upsert so later updates in the previous shard still apply
+	data, err := json.Marshal(&UserData{User: userData.User, Timestamp: userData.Timestamp})
+	if err != nil {
+		return err
+	}
+
+	return s.brokers[previous].Send(&utils.BrokerMessage{Id: uuid.NewString(), User: userData.User, EventType: utils.ProximityShardRelease, Body: string(data)})
+}
+
+// Remove a user released by this shard after they moved to another shard
+func (s *ShardedLocation) Release(body string) error {
+	userData := &UserData{}
+	if err := json.Unmarshal([]byte(body), userData); err != nil {
+		return err
+	}
+
+	s.Location.removeAt(userData.User, userData.Timestamp)
+
+	return nil
+}
+
+// Remove a user and their ownership
+func (s *ShardedLocation) Remove(user string) error {
+	if err := s.Location.Remove(user); err != nil {
+		return err
+	}
+
+	if shard, err := s.OwnerOf(user); err == nil && s.Owns(shard) {
+		return s.redis.HDel(s.ctx, s.ownerKey, user).Err()
+	}
+
+	return nil
+}
+
+// Find the shards which own a top level partition overlapping a bounding box which may cross the antimeridian
+func (s *ShardedLocation) covering(minLat float64, minLong float64, maxLat float64, maxLong float64) ([]int, error) {
+	size := 1 << ShardPrefixDepth
+	latSize := float64(LatMax-LatMin) / float64(size)
+	longSize := float64(LongMax-LongMin) / float64(size)
+
+	seen := make(map[int]bool)
+	shards := make([]int, 0)
+
+	for y := 0; y < size; y++ {
+		cellMinLat := LatMin + float64(y)*latSize
+		if cellMinLat > maxLat || cellMinLat+latSize < minLat {
+			continue
+		}
+
+		for x := 0; x < size; x++ {
+			cellMinLong := LongMin + float64(x)*longSize
+			cellMaxLong := cellMinLong + longSize
+
+			if minLong <= maxLong && (cellMinLong > maxLong || cellMaxLong < minLong) {
+				continue
+			}
+
+			if minLong > maxLong && cellMaxLong < minLong && cellMinLong > maxLong {
+				continue
+			}
+
+			shard, err := s.Owner(cellMinLat+latSize/2, cellMinLong+longSize/2)
+			if err != nil {
+				return nil, err
+			}
+
+			if !seen[shard] {
+				seen[shard] = true
+				shards = append(shards, shard)
+			}
+		}
+	}
+
+	return shards, nil
+}
+
+// Answer a query with the users held by this shard
+func (s *ShardedLocation) answer(query *ShardQuery) ([]*NearbyUser, error) {
+	switch query.Kind {
+	case ShardKindRadius:
+		return s.Location.Around(query.User, query.Lat, query.Long, query.Radius, query.Freshness)
+
+	case ShardKindBox:
+		return s.Location.Box(query.User, query.MinLat, query.MinLong, query.MaxLat, query.MaxLong, query.Freshness)
+
+	case ShardKindPolygon:
+		return s.Location.Polygon(query.User, query.Points, query.Freshness)
+
+	default:
+		return nil, errors.New("unknown shard query")
+	}
+}
+
+// Answer a query sent by another shard and send the result to the instance which asked
+func (s *ShardedLocation) Respond(body string) error {
+	query := &ShardQuery{}
+	if err := json.Unmarshal([]byte(body), query); err != nil {
+		return err
+	}
+
+	result := &ShardResult{Id: query.Id}
+
+	users, err := s.answer(query)
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		result.Users = users
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	return utils.NewBrokerRedis(s.ctx, s.redis, query.ReplyTo, s.serviceId).Send(&utils.BrokerMessage{Id: uuid.NewString(), EventType: utils.ProximityShardResult, Body: string(data)})
+}
+
+// Pass a result to the query waiting for it
+func (s *ShardedLocation) Resolve(body string) error {
+	result := &ShardResult{}
+	if err := json.Unmarshal([]byte(body), result); err != nil {
+		return err
+	}
+
+	// Results arriving after the timeout are dropped
+	if value, ok := s.pending.Load(result.Id); ok {
+		select {
+		case value.(chan *ShardResult) <- result:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// Run a query on every shard in the list and merge the users sorted by distance
+func (s *ShardedLocation) gather(query *ShardQuery, shards []int) ([]*NearbyUser, error) {
+	query.Id = uuid.NewString()
+	query.ReplyTo = s.replyTo
+
+	results := make(chan *ShardResult, len(shards))
+	s.pending.Store(query.Id, results)
+	defer s.pending.Delete(query.Id)
+
+	data, err := json.Marshal(query)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make(map[string]*NearbyUser)
+	merge := func(found []*NearbyUser) {
+		for _, user := range found {
+			// A user may briefly be held by two shards while moving between them
+			if existing, ok := users[user.Data.User]; !ok || user.Data.Timestamp.After(existing.Data.Timestamp) {
+				users[user.Data.User] = user
+			}
+		}
+	}
+
+	waiting := 0
+	for _, shard := range shards {
+		if s.Owns(shard) {
+			continue
+		}
+
+		if err := s.brokers[shard].Send(&utils.BrokerMessage{Id: uuid.NewString(), User: query.User, EventType: utils.ProximityShardQuery, Body: string(data)}); err != nil {
+			return nil, err
+		}
+
+		waiting += 1
+	}
+
+	local, err := s.answer(query)
+	if err != nil {
+		return nil, err
+	}
+	merge(local)
+
+	// Shards which do not answer in time are left out of the result
+	timeout := time.After(shardTimeout)
+
+wait:
+	for waiting > 0 {
+		select {
+		case result := <-results:
+			if result.Error == "" {
+				merge(result.Users)
+			}
+
+			waiting -= 1
+		case <-timeout:
+			break wait
+		}
+	}
+
+	out := make([]*NearbyUser, 0, len(users))
+	for _, user := range users {
+		out = append(out, user)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Distance < out[j].Distance
+	})
+
+	return out, nil
+}
+
+// Get nearby users across every shard within the radius sorted by distance
+func (s *ShardedLocation) Nearby(user string, radius float64, freshness time.Duration) ([]*NearbyUser, error) {
+	userData, err := s.Location.Get(user)
+	if err != nil {
+		return nil, err
+	}
+
+	shards, err := s.covering(BoundingBox(userData.Lat, userData.Long, radius))
+	if err != nil {
+		return nil, err
+	}
+
+	return s.gather(&ShardQuery{Kind: ShardKindRadius, User: user, Lat: userData.Lat, Long: userData.Long, Radius: radius, Freshness: freshness}, shards)
+}
+
+// Get users across every shard within a bounding box sorted by distance from the center of the box
+func (s *ShardedLocation) Box(user string, minLat float64, minLong float64, maxLat float64, maxLong float64, freshness time.Duration) ([]*NearbyUser, error) {
+	shards, err := s.covering(minLat, minLong, maxLat, maxLong)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.gather(&ShardQuery{Kind: ShardKindBox, User: user, MinLat: minLat, MinLong: minLong, MaxLat: maxLat, MaxLong: maxLong, Freshness: freshness}, shards)
+}
+
+// Get users across every shard within a polygon sorted by distance from the center of its bounds
+func (s *ShardedLocation) Polygon(user string, points []*Point, freshness time.Duration) ([]*NearbyUser, error) {
+	shards, err := s.covering(PolygonBounds(points))
+	if err != nil {
+		return nil, err
+	}
+
+	return s.gather(&ShardQuery{Kind: ShardKindPolygon, User: user, Points: points, Freshness: freshness}, shards)
+}
@@ -0,0 +1,46 @@
+package utils
+
+import "errors"
+
+// Index of user coordinates which is safe for concurrent use
+type SpatialIndex interface {
+	Insert(user string, lat float64, long float64) error
+	Move(user string, lat float64, long float64) error
+	Remove(user string)
+	QueryRadius(lat float64, long float64, radius float64) ([]string, error)
+	QueryBox(minLat float64, minLong float64, maxLat float64, maxLong float64) ([]string, error)
+}
+
+// Available spatial index implementations
+const (
+	SpatialIndexQuadtree = "quadtree"
+	SpatialIndexGeohash  = "geohash"
+)
+
+type SpatialIndexConfig struct {
+	Name   string
+	Depth  uint
+	Levels int
+}
+
+// Create a new spatial index from a config defaulting to a single level quadtree
+func NewSpatialIndex(config *SpatialIndexConfig) (SpatialIndex, error) {
+	switch config.Name {
+	case "", SpatialIndexQuadtree:
+		depth := config.Depth
+		if depth == 0 {
+			depth = DefaultPartitionDepth
+		}
+
+		levels := config.Levels
+		if levels == 0 {
+			levels = 1
+		}
+
+		return NewQuadtreeIndex(depth, levels)
+	case SpatialIndexGeohash:
+		return NewGeohashIndex(), nil
+	default:
+		return nil, errors.New("invalid spatial index")
+	}
+}
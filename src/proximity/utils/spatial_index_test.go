@@ -0,0 +1,233 @@
+package utils
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// Every spatial index implementation which must pass the conformance suite
+var spatialIndexConfigs = map[string]*SpatialIndexConfig{
+	"quadtree":            {Name: SpatialIndexQuadtree},
+	"quadtree/multilevel": {Name: SpatialIndexQuadtree, Depth: 14, Levels: 3},
+	"geohash":             {Name: SpatialIndexGeohash},
+}
+
+// Run a test against every spatial index implementation
+func eachSpatialIndex(t *testing.T, fn func(t *testing.T, index SpatialIndex)) {
+	for name, config := range spatialIndexConfigs {
+		t.Run(name, func(t *testing.T) {
+			index, err := NewSpatialIndex(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fn(t, index)
+		})
+	}
+}
+
+// Insert every point into an index
+func insertPoints(t testing.TB, index SpatialIndex, points []*testPoint) {
+	for _, point := range points {
+		if err := index.Insert(point.user, point.lat, point.long); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Find the users within a bounding box by checking every point
+func bruteForceBox(points []*testPoint, minLat float64, minLong float64, maxLat float64, maxLong float64) []string {
+	users := make([]string, 0)
+	for _, point := range points {
+		if InBox(point.lat, point.long, minLat, minLong, maxLat, maxLong) {
+			users = append(users, point.user)
+		}
+	}
+
+	return sortedUsers(users)
+}
+
+func TestSpatialIndexInsertTwice(t *testing.T) {
+	eachSpatialIndex(t, func(t *testing.T, index SpatialIndex) {
+		if err := index.Insert("a", 10, 10); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := index.Insert("a", 20, 20); err == nil {
+			t.Fatal("expected an error inserting an existing user")
+		}
+	})
+}
+
+func TestSpatialIndexMoveUnknown(t *testing.T) {
+	eachSpatialIndex(t, func(t *testing.T, index SpatialIndex) {
+		if err := index.Move("a", 10, 10); err == nil {
+			t.Fatal("expected an error moving an unknown user")
+		}
+	})
+}
+
+func TestSpatialIndexOutOfBounds(t *testing.T) {
+	eachSpatialIndex(t, func(t *testing.T, index SpatialIndex) {
+		if err := index.Insert("a", 91, 0); err == nil {
+			t.Fatal("expected an error inserting out of bounds")
+		}
+	})
+}
+
+func TestSpatialIndexMoveAndRemove(t *testing.T) {
+	eachSpatialIndex(t, func(t *testing.T, index SpatialIndex) {
+		if err := index.Insert("a", 37.7749, -122.4194); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := index.Move("a", 51.5074, -0.1278); err != nil {
+			t.Fatal(err)
+		}
+
+		users, err := index.QueryRadius(37.7749, -122.4194, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sameUsers(t, users, []string{})
+
+		users, err = index.QueryRadius(51.5074, -0.1278, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sameUsers(t, users, []string{"a"})
+
+		index.Remove("a")
+		index.Remove("a")
+
+		users, err = index.QueryBox(LatMin, LongMin, LatMax, LongMax)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sameUsers(t, users, []string{})
+	})
+}
+
+func TestSpatialIndexQueryRadius(t *testing.T) {
+	eachSpatialIndex(t, func(t *testing.T, index SpatialIndex) {
+		rng := rand.New(rand.NewSource(2))
+
+		points := randomPoints(rng, 3000, LatMin, LatMax)
+		insertPoints(t, index, points)
+
+		for _, radius := range []float64{1000, 50000, 500000, 3000000} {
+			for _, query := range randomPoints(rng, 40, LatMin, LatMax) {
+				users, err := index.QueryRadius(query.lat, query.long, radius)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				sameUsers(t, users, bruteForceRadius(points, query.lat, query.long, radius))
+			}
+		}
+	})
+}
+
+func TestSpatialIndexQueryRadiusAntimeridian(t *testing.T) {
+	eachSpatialIndex(t, func(t *testing.T, index SpatialIndex) {
+		points := []*testPoint{{"west", -17.7, 179.99}, {"east", -17.7, -179.99}, {"far", -17.7, 170}}
+		insertPoints(t, index, points)
+
+		users, err := index.QueryRadius(-17.7, 179.999, 5000)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sameUsers(t, users, []string{"east", "west"})
+	})
+}
+
+func TestSpatialIndexQueryBox(t *testing.T) {
+	eachSpatialIndex(t, func(t *testing.T, index SpatialIndex) {
+		rng := rand.New(rand.NewSource(3))
+
+		points := randomPoints(rng, 3000, LatMin, LatMax)
+		insertPoints(t, index, points)
+
+		for i := 0; i < 200; i++ {
+			corners := randomPoints(rng, 2, LatMin, LatMax)
+
+			// Boxes where the minimum longitude exceeds the maximum cross the antimeridian
+			minLat, maxLat := corners[0].lat, corners[1].lat
+			if minLat > maxLat {
+				minLat, maxLat = maxLat, minLat
+			}
+
+			minLong, maxLong := corners[0].long, corners[1].long
+
+			users, err := index.QueryBox(minLat, minLong, maxLat, maxLong)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sameUsers(t, users, bruteForceBox(points, minLat, minLong, maxLat, maxLong))
+		}
+	})
+}
+
+func TestSpatialIndexQueryBoxInvalid(t *testing.T) {
+	eachSpatialIndex(t, func(t *testing.T, index SpatialIndex) {
+		if _, err := index.QueryBox(10, 0, -10, 10); err == nil {
+			t.Fatal("expected an error for a box with the minimum latitude above the maximum")
+		}
+	})
+}
+
+// Run a benchmark against every spatial index implementation filled with random points
+func benchmarkSpatialIndex(b *testing.B, fn func(b *testing.B, index SpatialIndex, points []*testPoint)) {
+	for name, config := range spatialIndexConfigs {
+		b.Run(name, func(b *testing.B) {
+			index, err := NewSpatialIndex(config)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			points := randomPoints(rand.New(rand.NewSource(4)), 100000, -60, 70)
+			insertPoints(b, index, points)
+
+			b.ResetTimer()
+			fn(b, index, points)
+		})
+	}
+}
+
+func BenchmarkSpatialIndexMove(b *testing.B) {
+	benchmarkSpatialIndex(b, func(b *testing.B, index SpatialIndex, points []*testPoint) {
+		for i := 0; i < b.N; i++ {
+			point := points[i%len(points)]
+			if err := index.Move(point.user, point.lat+float64(i%2)*0.01, point.long); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkSpatialIndexQueryRadius(b *testing.B) {
+	benchmarkSpatialIndex(b, func(b *testing.B, index SpatialIndex, points []*testPoint) {
+		for i := 0; i < b.N; i++ {
+			point := points[i%len(points)]
+			if _, err := index.QueryRadius(point.lat, point.long, 5000); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkSpatialIndexQueryBox(b *testing.B) {
+	benchmarkSpatialIndex(b, func(b *testing.B, index SpatialIndex, points []*testPoint) {
+		for i := 0; i < b.N; i++ {
+			point := points[i%len(points)]
+			if _, err := index.QueryBox(BoundingBox(point.lat, point.long, 10000)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,242 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/bengosborn/cue/helpers"
+	"github.com/redis/go-redis/v9"
+)
+
+type Subscription struct {
+	User     string  `json:"user"`
+	Receiver string  `json:"receiver"`
+	Radius   float64 `json:"radius"`
+}
+
+type NearbyAlert struct {
+	Subscription *Subscription `json:"-"`
+	User         string        `json:"user"`
+	Distance     float64       `json:"distance"`
+	Timestamp    time.Time     `json:"timestamp"`
+}
+
+type Subscriptions struct {
+	ctx   context.Context
+	redis *redis.Client
+	ttl   time.Duration
+}
+
+const (
+	subscriptionRegistryKey = "subscription:registry"
+	subscriptionGeoPrefix   = "subscription:geo"
+	subscriptionSeenPrefix  = "subscription:seen"
+	subscriptionAlertPrefix = "subscription:alert"
+)
+
+// Track the position of a subscribed user then find the subscribed users seen since the cutoff within the radius of where the user is shown and forget the rest
+var subscribersScript = redis.NewScript(`
+if redis.call("HEXISTS", KEYS[1], ARGV[1]) == 1 then
+	redis.call("GEOADD", KEYS[2], ARGV[2], ARGV[3], ARGV[1])
+	redis.call("ZADD", KEYS[3], ARGV[7], ARGV[1])
+end
+
+local found = redis.call("GEOSEARCH", KEYS[2], "FROMLONLAT", ARGV[4], ARGV[5], "BYRADIUS", ARGV[6], "m", "WITHCOORD")
+local out = {}
+
+for _, entry in ipairs(found) do
+	local seen = redis.call("ZSCORE", KEYS[3], entry[1])
+
+	if seen and tonumber(seen) >= tonumber(ARGV[8]) and redis.call("HEXISTS", KEYS[1], entry[1]) == 1 then
+		table.insert(out, entry)
+	else
+		redis.call("ZREM", KEYS[2], entry[1])
+		redis.call("ZREM", KEYS[3], entry[1])
+	end
+end
+
+return out
+`)
+
+// Parse and validate a nearby subscription from a message body
+func NewSubscription(body string, user string, receiver string) (*Subscription, error) {
+	subscription := &Subscription{}
+
+	if body != "" {
+		if err := json.Unmarshal([]byte(body), subscription); err != nil {
+			return nil, errors.New("invalid subscription")
+		}
+	}
+
+	if subscription.Radius == 0 {
+		subscription.Radius = DefaultNearbyRadius
+	}
+
+	if subscription.Radius < 0 || subscription.Radius > MaxNearbyRadius {
+		return nil, errors.New("radius out of bounds")
+	}
+
+	subscription.User = user
+	subscription.Receiver = receiver
+
+	return subscription, nil
+}
+
+// Make a new subscription registry where alerts for the same pair of users repeat at most once per ttl
+func NewSubscriptions(ctx context.Context, redis *redis.Client, ttl time.Duration) *Subscriptions {
+	return &Subscriptions{ctx: ctx, redis: redis, ttl: ttl}
+}
+
+// Store a subscription
+func (s *Subscriptions) Subscribe(subscription *Subscription) error {
+	data, err := json.Marshal(subscription)
+	if err != nil {
+		return err
+	}
+
+	return s.redis.HSet(s.ctx, subscriptionRegistryKey, subscription.User, data).Err()
+}
+
+// Remove a subscription where the subscriber is dropped from the index of each group on the next search
+func (s *Subscriptions) Unsubscribe(user string) error {
+	return s.redis.HDel(s.ctx, subscriptionRegistryKey, user).Err()
+}
+
+// Update the receiver of a subscribed user if it has changed
+func (s *Subscriptions) Refresh(user string, receiver string) error {
+	data, err := s.redis.HGet(s.ctx, subscriptionRegistryKey, user).Result()
+	if err == redis.Nil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	subscription := &Subscription{}
+	if err := json.Unmarshal([]byte(data), subscription); err != nil {
+		return err
+	}
+
+	if subscription.Receiver == receiver {
+		return nil
+	}
+
+	subscription.Receiver = receiver
+
+	return s.Subscribe(subscription)
+}
+
+// Parse the subscribers found by the script into their coordinates
+func parseSubscribers(found []interface{}) (map[string]*Point, error) {
+	out := make(map[string]*Point)
+
+	for _, value := range found {
+		entry, ok := value.([]interface{})
+		if !ok || len(entry) != 2 {
+			return nil, errors.New("invalid subscriber")
+		}
+
+		user, ok := entry[0].(string)
+		coords, ok2 := entry[1].([]interface{})
+		if !ok || !ok2 || len(coords) != 2 {
+			return nil, errors.New("invalid subscriber")
+		}
+
+		long, err := strconv.ParseFloat(fmt.Sprint(coords[0]), 64)
+		if err != nil {
+			return nil, err
+		}
+
+		lat, err := strconv.ParseFloat(fmt.Sprint(coords[1]), 64)
+		if err != nil {
+			return nil, err
+		}
+
+		out[user] = &Point{Lat: lat, Long: long}
+	}
+
+	return out, nil
+}
+
+// Find the subscribers of a group who should be alerted that a user shown at a position has come within their radius
+func (s *Subscriptions) Affected(group string, userData *UserData, lat float64, long float64) ([]*NearbyAlert, error) {
+	// Redis geo sets cannot hold users past the web mercator bounds
+	if math.Abs(userData.Lat) > GeoLatLimit || math.Abs(lat) > GeoLatLimit {
+		return nil, nil
+	}
+
+	// Subscribers are indexed separately so a user with no subscribers nearby costs a single call
+	keys := []string{subscriptionRegistryKey, GroupKey(subscriptionGeoPrefix, group), GroupKey(subscriptionSeenPrefix, group)}
+	args := []interface{}{userData.User, userData.Long, userData.Lat, long, lat, MaxNearbyRadius * geoRadiusPadding, toScore(userData.Timestamp), toScore(time.Now().Add(-s.ttl))}
+
+	found, err := subscribersScript.Run(s.ctx, s.redis, keys, args...).Slice()
+	if err != nil {
+		return nil, err
+	}
+
+	subscribers, err := parseSubscribers(found)
+	if err != nil {
+		return nil, err
+	}
+
+	delete(subscribers, userData.User)
+
+	users := make([]string, 0, len(subscribers))
+	for user := range subscribers {
+		users = append(users, user)
+	}
+
+	if len(users) == 0 {
+		return nil, nil
+	}
+
+	raw, err := s.redis.HMGet(s.ctx, subscriptionRegistryKey, users...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	alerts := make([]*NearbyAlert, 0)
+
+	for i, value := range raw {
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+
+		subscription := &Subscription{}
+		if err := json.Unmarshal([]byte(data), subscription); err != nil {
+			return nil, err
+		}
+
+		subscriber := subscribers[users[i]]
+
+		distance := Haversine(subscriber.Lat, subscriber.Long, lat, long)
+		if distance > subscription.Radius {
+			continue
+		}
+
+		// Only alert when the pair was not already near
+		alertKey := helpers.FormatKey(subscriptionAlertPrefix, subscription.User, userData.User)
+
+		created, err := s.redis.SetNX(s.ctx, alertKey, "TRUE", s.ttl).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		if !created {
+			if err := s.redis.Expire(s.ctx, alertKey, s.ttl).Err(); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		alerts = append(alerts, &NearbyAlert{Subscription: subscription, User: userData.User, Distance: math.Round(distance), Timestamp: userData.Timestamp})
+	}
+
+	return alerts, nil
+}
@@ -0,0 +1,38 @@
+package utils
+
+import "testing"
+
+func TestParseSubscribers(t *testing.T) {
+	// Replies from the script as decoded by the redis client
+	found := []interface{}{
+		[]interface{}{"a", []interface{}{"-122.41940140724182", "37.77490054977"}},
+		[]interface{}{"b", []interface{}{"0.1", "51.5"}},
+	}
+
+	subscribers, err := parseSubscribers(found)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(subscribers) != 2 || subscribers["b"].Lat != 51.5 || subscribers["b"].Long != 0.1 {
+		t.Fatalf("got subscribers %v", subscribers)
+	}
+
+	if Haversine(subscribers["a"].Lat, subscribers["a"].Long, 37.7749, -122.4194) > 1 {
+		t.Fatalf("got subscriber a at %v", subscribers["a"])
+	}
+
+	if _, err := parseSubscribers([]interface{}{[]interface{}{"a"}}); err == nil {
+		t.Fatal("got no error for a subscriber without coordinates")
+	}
+}
+
+func TestGroupKey(t *testing.T) {
+	if key := GroupKey(subscriptionGeoPrefix, ""); key != "subscription:geo" {
+		t.Fatalf("got key %s for the default group", key)
+	}
+
+	if key := GroupKey(subscriptionGeoPrefix, "hikers"); key != "subscription:geo:hikers" {
+		t.Fatalf("got key %s for a group", key)
+	}
+}
@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+)
+
+type UserData struct {
+	User      string    `json:"user"`
+	Lat       float64   `json:"lat"`
+	Long      float64   `json:"long"`
+	Timestamp time.Time `json:"timestamp"`
+	Reading
+	Removed bool `json:"removed,omitempty"`
+}
+
+// Optional readings reported with a fix where accuracy and altitude are in meters, heading in degrees from north and speed in meters per second
+type Reading struct {
+	Accuracy *float64 `json:"accuracy,omitempty"`
+	Altitude *float64 `json:"altitude,omitempty"`
+	Heading  *float64 `json:"heading,omitempty"`
+	Speed    *float64 `json:"speed,omitempty"`
+}
+
+// Number which older clients sent as a string
+type compatNumber float64
+
+// Bounds for the readings of a fix
+const (
+	MaxAccuracy = 100000
+	MinAltitude = -20000
+	MaxAltitude = 100000
+	MaxHeading  = 360
+	MaxSpeed    = 100000
+)
+
+// Decode a number or a string holding a number
+func (n *compatNumber) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		text = string(data)
+	}
+
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return errors.New("invalid number")
+	}
+
+	*n = compatNumber(value)
+
+	return nil
+}
+
+// Convert an optional number to an optional reading
+func (n *compatNumber) reading() *float64 {
+	if n == nil {
+		return nil
+	}
+
+	value := float64(*n)
+
+	return &value
+}
+
+// Decode user data accepting coordinates and readings sent as strings by older clients
+func (u *UserData) UnmarshalJSON(data []byte) error {
+	type alias UserData
+
+	aux := &struct {
+		Lat      *compatNumber `json:"lat"`
+		Long     *compatNumber `json:"long"`
+		Accuracy *compatNumber `json:"accuracy"`
+		Altitude *compatNumber `json:"altitude"`
+		Heading  *compatNumber `json:"heading"`
+		Speed    *compatNumber `json:"speed"`
+		*alias
+	}{alias: (*alias)(u)}
+
+	if err := json.Unmarshal(data, aux); err != nil {
+		return err
+	}
+
+	// Missing coordinates would otherwise place the user at 0, 0
+	if aux.Lat == nil {
+		return errors.New("latitude must be a number between -90 and 90")
+	}
+
+	if aux.Long == nil {
+		return errors.New("longitude must be a number between -180 and 180")
+	}
+
+	u.Lat = float64(*aux.Lat)
+	u.Long = float64(*aux.Long)
+	u.Reading = Reading{Accuracy: aux.Accuracy.reading(), Altitude: aux.Altitude.reading(), Heading: aux.Heading.reading(), Speed: aux.Speed.reading()}
+
+	return nil
+}
+
+// Check if a number is neither NaN nor infinite
+func finite(value float64) bool {
+	return !math.IsNaN(value) && !math.IsInf(value, 0)
+}
+
+// Check if an optional reading is finite and within bounds
+func validReading(value *float64, min float64, max float64) bool {
+	return value == nil || finite(*value) && *value >= min && *value <= max
+}
+
+// Validate the coordinates and readings of a fix
+func (u *UserData) Validate() error {
+	if !finite(u.Lat) || u.Lat < LatMin || u.Lat > LatMax {
+		return errors.New("latitude must be a number between -90 and 90")
+	}
+
+	if !finite(u.Long) || u.Long < LongMin || u.Long > LongMax {
+		return errors.New("longitude must be a number between -180 and 180")
+	}
+
+	if !validReading(u.Accuracy, 0, MaxAccuracy) {
+		return errors.New("accuracy must be a number between 0 and 100000")
+	}
+
+	if !validReading(u.Altitude, MinAltitude, MaxAltitude) {
+		return errors.New("altitude must be a number between -20000 and 100000")
+	}
+
+	// A heading of 360 is north again
+	if !validReading(u.Heading, 0, MaxHeading) || u.Heading != nil && *u.Heading == MaxHeading {
+		return errors.New("heading must be a number from 0 up to 360")
+	}
+
+	if !validReading(u.Speed, 0, MaxSpeed) {
+		return errors.New("speed must be a number between 0 and 100000")
+	}
+
+	return nil
+}
+
+// Copy a fix as the stored location of a user
+func (u *UserData) copyFor(user string) *UserData {
+	return &UserData{User: user, Lat: u.Lat, Long: u.Long, Timestamp: u.Timestamp, Reading: u.Reading}
+}
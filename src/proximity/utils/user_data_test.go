@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestUserDataUnmarshal(t *testing.T) {
+	tests := []struct {
+		body  string
+		valid bool
+	}{
+		{`{"lat": 37.774912, "long": -122.419415}`, true},
+		{`{"lat": "37.774912", "long": "-122.419415", "accuracy": "5"}`, true},
+		{`{"lat": 0, "long": 0}`, true},
+		{`{}`, false},
+		{`{"lat": 37.7749}`, false},
+		{`{"long": -122.4194}`, false},
+		{`{"lat": null, "long": -122.4194}`, false},
+		{`{"lat": "north", "long": -122.4194}`, false},
+		{`{"lat": 91, "long": -122.4194}`, false},
+		{`{"lat": "NaN", "long": -122.4194}`, false},
+	}
+
+	for _, test := range tests {
+		userData := &UserData{}
+
+		err := json.Unmarshal([]byte(test.body), userData)
+		if err == nil {
+			err = userData.Validate()
+		}
+
+		if (err == nil) != test.valid {
+			t.Fatalf("got error %v for %s, want valid %t", err, test.body, test.valid)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/bengosborn/cue/helpers"
+	"github.com/redis/go-redis/v9"
+)
+
+type VisibilitySettings struct {
+	Mode    string   `json:"mode"`
+	Blocked []string `json:"blocked"`
+	Friends []string `json:"friends"`
+}
+
+type VisibilityTarget struct {
+	User string `json:"user"`
+}
+
+type Visibility struct {
+	ctx   context.Context
+	redis *redis.Client
+}
+
+const (
+	visibilityModeKey      = "visibility:mode"
+	visibilityBlockPrefix  = "visibility:block"
+	visibilityFriendPrefix = "visibility:friend"
+
+	// Who can see a user
+	VisibilityEveryone = "everyone"
+	VisibilityFriends  = "friends"
+
+	MaxBlockedUsers = 1000
+	MaxFriends      = 1000
+)
+
+// Parse the user targeted by a block or friend change from a message body
+func NewVisibilityTarget(body string, user string) (*VisibilityTarget, error) {
+	target := &VisibilityTarget{}
+	if err := json.Unmarshal([]byte(body), target); err != nil {
+		return nil, errors.New("invalid visibility target")
+	}
+
+	if target.User == "" || target.User == user {
+		return nil, errors.New("invalid visibility target")
+	}
+
+	return target, nil
+}
+
+// Parse a visibility mode from a message body
+func NewVisibilityMode(body string) (string, error) {
+	settings := &VisibilitySettings{}
+	if err := json.Unmarshal([]byte(body), settings); err != nil {
+		return "", errors.New("invalid visibility mode")
+	}
+
+	if settings.Mode != VisibilityEveryone && settings.Mode != VisibilityFriends {
+		return "", errors.New("invalid visibility mode")
+	}
+
+	return settings.Mode, nil
+}
+
+// Make a new visibility store
+func NewVisibility(ctx context.Context, redis *redis.Client) *Visibility {
+	return &Visibility{ctx: ctx, redis: redis}
+}
+
+// Add a user to a bounded set
+func (v *Visibility) add(key string, user string, limit int64) error {
+	count, err := v.redis.SCard(v.ctx, key).Result()
+	if err != nil {
+		return err
+	}
+
+	if count >= limit {
+		return errors.New("too many users")
+	}
+
+	return v.redis.SAdd(v.ctx, key, user).Err()
+}
+
+// Block a user so neither user can see the other
+func (v *Visibility) Block(user string, target string) error {
+	return v.add(helpers.FormatKey(visibilityBlockPrefix, user), target, MaxBlockedUsers)
+}
+
+// Unblock a user
+func (v *Visibility) Unblock(user string, target string) error {
+	return v.redis.SRem(v.ctx, helpers.FormatKey(visibilityBlockPrefix, user), target).Err()
+}
+
+// Add a friend who can see the user in the friends mode
+func (v *Visibility) AddFriend(user string, target string) error {
+	return v.add(helpers.FormatKey(visibilityFriendPrefix, user), target, MaxFriends)
+}
+
+// Remove a friend
+func (v *Visibility) RemoveFriend(user string, target string) error {
+	return v.redis.SRem(v.ctx, helpers.FormatKey(visibilityFriendPrefix, user), target).Err()
+}
+
+// Set who can see the user
+func (v *Visibility) SetMode(user string, mode string) error {
+	return v.redis.HSet(v.ctx, visibilityModeKey, user, mode).Err()
+}
+
+// Get the visibility settings of a user which default to being visible to everyone
+func (v *Visibility) Get(user string) (*VisibilitySettings, error) {
+	pipe := v.redis.Pipeline()
+	modeCmd := pipe.HGet(v.ctx, visibilityModeKey, user)
+	blockedCmd := pipe.SMembers(v.ctx, helpers.FormatKey(visibilityBlockPrefix, user))
+	friendsCmd := pipe.SMembers(v.ctx, helpers.FormatKey(visibilityFriendPrefix, user))
+
+	if _, err := pipe.Exec(v.ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	mode := modeCmd.Val()
+	if mode == "" {
+		mode = VisibilityEveryone
+	}
+
+	return &VisibilitySettings{Mode: mode, Blocked: blockedCmd.Val(), Friends: friendsCmd.Val()}, nil
+}
+
+// Find which targets the viewer is allowed to see where a block by either user hides both
+func (v *Visibility) visible(viewer string, targets []string) ([]bool, error) {
+	out := make([]bool, len(targets))
+	if len(targets) == 0 {
+		return out, nil
+	}
+
+	pipe := v.redis.Pipeline()
+	blockedCmd := pipe.SMembers(v.ctx, helpers.FormatKey(visibilityBlockPrefix, viewer))
+	modesCmd := pipe.HMGet(v.ctx, visibilityModeKey, targets...)
+
+	blocksCmds := make([]*redis.BoolCmd, len(targets))
+	friendCmds := make([]*redis.BoolCmd, len(targets))
+	for i, target := range targets {
+		blocksCmds[i] = pipe.SIsMember(v.ctx, helpers.FormatKey(visibilityBlockPrefix, target), viewer)
+		friendCmds[i] = pipe.SIsMember(v.ctx, helpers.FormatKey(visibilityFriendPrefix, target), viewer)
+	}
+
+	if _, err := pipe.Exec(v.ctx); err != nil {
+		return nil, err
+	}
+
+	blocked := make(map[string]bool)
+	for _, user := range blockedCmd.Val() {
+		blocked[user] = true
+	}
+
+	modes := modesCmd.Val()
+
+	for i, target := range targets {
+		if target == viewer {
+			out[i] = true
+			continue
+		}
+
+		if blocked[target] || blocksCmds[i].Val() {
+			continue
+		}
+
+		if mode, ok := modes[i].(string); ok && mode == VisibilityFriends && !friendCmds[i].Val() {
+			continue
+		}
+
+		out[i] = true
+	}
+
+	return out, nil
+}
+
+// Check if the viewer is allowed to see the target
+func (v *Visibility) Visible(viewer string, target string) (bool, error) {
+	out, err := v.visible(viewer, []string{target})
+	if err != nil {
+		return false, err
+	}
+
+	return out[0], nil
+}
+
+// Keep the nearby users the viewer is allowed to see
+func (v *Visibility) Filter(viewer string, users []*NearbyUser) ([]*NearbyUser, error) {
+	targets := make([]string, len(users))
+	for i, user := range users {
+		targets[i] = user.Data.User
+	}
+
+	visible, err := v.visible(viewer, targets)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]*NearbyUser, 0, len(users))
+	for i, user := range users {
+		if visible[i] {
+			out = append(out, user)
+		}
+	}
+
+	return out, nil
+}
@@ -9,4 +9,37 @@ const (
 	// Proximity service events
 	ProximitySendLocation
 	ProximityRequestNearby
+	ProximityRequestBox
+	ProximityRequestPolygon
+	ProximityCreateGeofence
+	ProximityDeleteGeofence
+	ProximityListGeofences
+	ProximityGeofenceEnter
+	ProximityGeofenceExit
+	ProximitySubscribeNearby
+	ProximityUnsubscribeNearby
+	ProximityNearbyAlert
+	ProximitySendLocationBatch
+	ProximityRequestTrail
+	ProximityRemoveLocation
+
+	// Proximity events exchanged between shards
+	ProximityShardQuery
+	ProximityShardResult
+	ProximityShardRelease
+
+	// Proximity privacy events
+	ProximitySetPrivacy
+	ProximityGetPrivacy
+
+	// Proximity visibility events
+	ProximityBlockUser
+	ProximityUnblockUser
+	ProximityAddFriend
+	ProximityRemoveFriend
+	ProximitySetVisibility
+	ProximityGetVisibility
+
+	// Security events sent to the security channel
+	SecurityImpossibleMovement
 )